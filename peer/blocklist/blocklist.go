@@ -0,0 +1,243 @@
+// Package blocklist keeps the addresses we refuse to exchange data with,
+// from a range file or banned for sending bad data.
+package blocklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MaxHashFailures is how many pieces failing the SHA-1 check a peer may send
+// before it is banned
+var MaxHashFailures = 3
+
+// Range is an inclusive range of addresses with what the list says about it
+type Range struct {
+	Label string
+	Start netip.Addr
+	End   netip.Addr
+}
+
+func (r Range) contains(addr netip.Addr) bool {
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+// String formats the range as a line of a P2P (PeerGuardian) list
+func (r Range) String() string {
+	label := r.Label
+	if label == "" {
+		label = "blocked"
+	}
+	return fmt.Sprintf("%s:%s-%s", label, r.Start, r.End)
+}
+
+// ParseRange reads one entry in any of the formats of a blocklist file:
+// "label:1.2.3.0-1.2.3.255" (P2P), "1.2.3.0-1.2.3.255", "1.2.3.0/24" or a
+// single address.
+func ParseRange(line string) (Range, error) {
+	line = strings.TrimSpace(line)
+	if r, err := parseAddrs(line); err == nil {
+		return r, nil
+	}
+	// The label of a P2P entry may itself contain colons
+	if i := strings.LastIndex(line, ":"); i > 0 {
+		if r, err := parseAddrs(line[i+1:]); err == nil {
+			r.Label = strings.TrimSpace(line[:i])
+			return r, nil
+		}
+	}
+	return Range{}, fmt.Errorf("invalid range: %s", line)
+}
+
+func parseAddrs(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		prefix = prefix.Masked()
+		return Range{Start: prefix.Addr(), End: lastAddr(prefix)}, nil
+	}
+	if start, end, found := strings.Cut(s, "-"); found {
+		from, err := netip.ParseAddr(strings.TrimSpace(start))
+		if err != nil {
+			return Range{}, err
+		}
+		to, err := netip.ParseAddr(strings.TrimSpace(end))
+		if err != nil {
+			return Range{}, err
+		}
+		from, to = from.Unmap(), to.Unmap()
+		if from.Is4() != to.Is4() || to.Less(from) {
+			return Range{}, errors.New("invalid range")
+		}
+		return Range{Start: from, End: to}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Range{}, err
+	}
+	return Range{Start: addr.Unmap(), End: addr.Unmap()}, nil
+}
+
+// lastAddr returns the highest address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - uint(bit%8))
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// List is a set of blocked ranges plus the peers banned automatically
+type List struct {
+	mu       sync.Mutex
+	ranges   []Range
+	failures map[netip.Addr]int
+}
+
+// Default is the list applied to incoming and outgoing connections
+var Default = New()
+
+// New creates an empty list
+func New() *List {
+	return &List{failures: make(map[netip.Addr]int)}
+}
+
+// Load adds the ranges of a blocklist file and returns how many were read.
+// Blank lines and lines starting with # are skipped.
+func (l *List) Load(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var ranges []Range
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRange(line)
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	l.ranges = append(l.ranges, ranges...)
+	l.mu.Unlock()
+	return len(ranges), nil
+}
+
+// Save writes every range in P2P format
+func (l *List) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, r := range l.Ranges() {
+		if _, err := fmt.Fprintln(file, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add blocks a range
+func (l *List) Add(r Range) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ranges = append(l.ranges, r)
+}
+
+// Remove unblocks every range overlapping r and returns how many there were.
+// The hash failures of the addresses in r are forgotten too.
+func (l *List) Remove(r Range) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.ranges[:0]
+	removed := 0
+	for _, blocked := range l.ranges {
+		if blocked.Start.Compare(r.End) <= 0 && r.Start.Compare(blocked.End) <= 0 {
+			removed++
+			continue
+		}
+		kept = append(kept, blocked)
+	}
+	l.ranges = kept
+	for addr := range l.failures {
+		if r.contains(addr) {
+			delete(l.failures, addr)
+		}
+	}
+	return removed
+}
+
+// Ranges returns a copy of the blocked ranges
+func (l *List) Ranges() []Range {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Range(nil), l.ranges...)
+}
+
+// Blocked reports whether an address, with or without a port, is blocked and
+// the range blocking it.
+func (l *List) Blocked(address string) (string, bool) {
+	addr, ok := parseHost(address)
+	if !ok {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.ranges {
+		if r.contains(addr) {
+			return r.String(), true
+		}
+	}
+	return "", false
+}
+
+// HashFailed charges a peer with a piece that failed the SHA-1 check. It
+// reports true when that gets the peer banned, on the failure past
+// MaxHashFailures.
+func (l *List) HashFailed(address string) bool {
+	addr, ok := parseHost(address)
+	if !ok {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[addr]++
+	if l.failures[addr] != MaxHashFailures+1 {
+		return false
+	}
+	l.ranges = append(l.ranges, Range{
+		Label: fmt.Sprintf("banned after %d bad pieces", l.failures[addr]),
+		Start: addr,
+		End:   addr,
+	})
+	return true
+}
+
+func parseHost(address string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
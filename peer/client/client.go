@@ -2,15 +2,16 @@ package client
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"tcp-app/ratelimit"
+	"tcp-app/storage"
 	"tcp-app/torrent"
 )
 
@@ -19,7 +20,127 @@ type AddrAndFilename struct {
 	Filename string
 }
 
-var connectedTrackerAddresses []AddrAndFilename
+// The trackers we announced to, downloads running in the background add to
+// them
+var (
+	trackersMu                sync.Mutex
+	connectedTrackerAddresses []AddrAndFilename
+)
+
+// rememberTracker records a tracker we announced a file to. It reports
+// false if it was recorded already.
+func rememberTracker(trackerAddress string, filename string) bool {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	for _, tracker := range connectedTrackerAddresses {
+		if tracker.Addr == trackerAddress && tracker.Filename == filename {
+			return false
+		}
+	}
+	connectedTrackerAddresses = append(connectedTrackerAddresses, AddrAndFilename{Addr: trackerAddress, Filename: filename})
+	return true
+}
+
+// errChoked is returned when the peer has no upload slot for us right now
+var errChoked = errors.New("choked by peer")
+
+// errHashMismatch is returned for a piece whose data does not match its hash
+var errHashMismatch = errors.New("hash mismatch")
+
+// dialTimeout bounds connecting to a peer or a tracker
+const dialTimeout = 5 * time.Second
+
+// dial connects to address, giving up when ctx is done
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("connection failed: %v", err)
+	}
+	return conn, nil
+}
+
+// deadline returns the time an operation taking at most timeout must end
+// by, earlier if ctx has a deadline before that
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	end := time.Now().Add(timeout)
+	if ctxEnd, ok := ctx.Deadline(); ok && ctxEnd.Before(end) {
+		return ctxEnd
+	}
+	return end
+}
+
+// abortOnDone unblocks every read and write on conn once ctx is done. The
+// returned function stops watching ctx.
+func abortOnDone(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// ctxErr returns ctx.Err() for an operation cut short by ctx, err otherwise
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// trackerConn connects to a tracker for one exchange bounded by ctx
+func trackerConn(ctx context.Context, trackerAddress string) (net.Conn, func(), error) {
+	conn, err := dial(ctx, trackerAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(deadline(ctx, trackerTimeout))
+	stop := abortOnDone(ctx, conn)
+	return conn, func() {
+		stop()
+		conn.Close()
+	}, nil
+}
+
+// trackerTimeout bounds one exchange with a tracker
+const trackerTimeout = 10 * time.Second
+
+// How long a worker keeps retrying a piece while the peer is choking us.
+// The seeder rotates its slots every 10 seconds.
+const (
+	chokeRetryDelay = 2 * time.Second
+	chokeWaitLimit  = 2 * time.Minute
+)
+
+// DownloadLimits throttles the piece data we receive, globally and per torrent
+var DownloadLimits = ratelimit.NewSet()
+
+// pieceReadTimeout bounds how long receiving one piece may take, throttling included
+const pieceReadTimeout = 60 * time.Second
+
+// Bytes received from each peer host, used by the server for tit-for-tat
+var (
+	downloadedMu   sync.Mutex
+	downloadedFrom = make(map[string]int64)
+)
+
+func recordDownloaded(address string, n int) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	downloadedMu.Lock()
+	downloadedFrom[host] += int64(n)
+	downloadedMu.Unlock()
+}
+
+// DownloadedFrom returns the total number of piece bytes received from host.
+func DownloadedFrom(host string) int64 {
+	downloadedMu.Lock()
+	defer downloadedMu.Unlock()
+	return downloadedFrom[host]
+}
 
 type PieceWork struct {
 	Index int
@@ -27,10 +148,13 @@ type PieceWork struct {
 	Size  int64
 }
 
+// PieceResult is a piece that passed its SHA-1 check, or the error that made
+// us give it up
 type PieceResult struct {
 	Index int
 	Data  []byte
 	Error error
+	Peer  string // address of the peer that sent the piece
 }
 
 // TorrentInfo struct để parse JSON
@@ -41,225 +165,189 @@ type TorrentInfo struct {
 	PieceHashes string `json:"PieceHashes"`
 }
 
-func StartDownload(torrentFile string, anotherPeerAddress []string, peerAddress string) {
+// StartDownload downloads a torrent from the peers its tracker knows, plus
+// the extraPeers given by hand. When ctx is cancelled the pieces in flight are
+// given up, and the files already complete are still written and announced.
+// It returns nil once every file is complete, ctx.Err() when cancelled, and
+// otherwise why the download stopped; what was verified is kept for the next
+// attempt.
+func StartDownload(ctx context.Context, torrentFile string, extraPeers []string, peerAddress string) error {
 	fmt.Println("Starting download for:", torrentFile)
 
 	// Parse torrent file using the torrent package
 	tfs, err := torrent.Open("torrent_files/" + torrentFile)
 	if err != nil {
-		fmt.Printf("Error opening torrent file: %v\n", err)
-		return
+		return fmt.Errorf("error opening torrent file: %v", err)
 	}
 
-	// Mock the list of peers
-	peers := anotherPeerAddress
-
-	// First, test connection and handshake with peers
-	var activePeers []string
-	for _, peer := range peers {
-		fmt.Printf("Testing connection to peer: %s\n", peer)
-		err := TestConnection(peer)
-		if err != nil {
-			fmt.Printf("Peer %s is not available: %v\n", peer, err)
-			continue
-		}
-		fmt.Printf("Peer %s is available\n", peer)
-		// Use the first file's InfoHash for handshake (assuming all files share the same InfoHash)
-		if err := performHandshake(peer, tfs[0].InfoHash[:]); err != nil {
-			fmt.Printf("Handshake failed with peer %s: %v\n", peer, err)
-			continue
-		}
-		activePeers = append(activePeers, peer)
-	}
-
-	if len(activePeers) == 0 {
-		fmt.Println("No available active peers found!")
-		return
+	// Open one session per peer for the whole torrent, the handshake binds it
+	// to the torrent and every piece request then goes over that connection
+	infoHash, err := torrent.InfoHash(tfs)
+	if err != nil {
+		return fmt.Errorf("error hashing torrent: %v", err)
 	}
+	torrentHash := fmt.Sprintf("%x", infoHash)
 
-	// Process each file in the torrent
-	for _, tf := range tfs {
-		fmt.Printf("Downloading file: %s\n", tf.Name)
+	// Pieces are numbered across the files of the torrent, so the whole
+	// torrent is downloaded in one pass
+	pieces := torrent.Pieces(tfs)
 
-		// Create channels for the worker pool
-		const numWorkers = 3
-		workQueue := make(chan PieceWork, len(tf.PieceHashes))
-		results := make(chan PieceResult, len(tf.PieceHashes))
+	// Verified pieces are written to partial files as they arrive and served
+	// to other peers while we download. What an earlier run wrote is kept.
+	partial, err := storage.Open(torrentHash, tfs)
+	if err != nil {
+		return fmt.Errorf("error opening download: %v", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	have := partial.Bitfield()
+	if have.Count() > 0 {
+		fmt.Printf("Resuming download: %d/%d pieces already verified\n", have.Count(), len(pieces))
+	}
 
-		// Enqueue work for current file
-		for i, hash := range tf.PieceHashes {
-			workQueue <- PieceWork{
-				Index: i,
-				Hash:  hash[:],
-				Size:  int64(tf.PieceLength),
+	if have.Count() < len(pieces) {
+		// Create the queue and results channel for the worker pool, with
+		// only the pieces still missing
+		workQueue := newPieceQueue(len(pieces), pickerForDownload())
+		results := make(chan PieceResult, len(pieces))
+		for i, piece := range pieces {
+			if have.Has(i) {
+				continue
 			}
+			workQueue.pieces = append(workQueue.pieces, PieceWork{
+				Index: i,
+				Hash:  piece.Hash[:],
+				Size:  int64(piece.Length),
+			})
 		}
-		close(workQueue)
-
-		// Start workers for current file
-		var wg sync.WaitGroup
-		for i := 0; i < numWorkers; i++ {
-			wg.Add(1)
-			peerIndex := i % len(activePeers)
-			go func(peer string) {
-				defer wg.Done()
-				downloadWorker(peer, workQueue, results, tf.InfoHash[:])
-			}(activePeers[peerIndex])
+
+		// Peers come from the tracker, plus the ones given by hand. One
+		// worker runs per peer session and new peers join as they appear.
+		peers := newPeerSet(ctx, tfs, infoHash[:], peerAddress, extraPeers, workQueue, results)
+		downloadsMu.Lock()
+		downloads[torrentFile] = peers
+		downloadsMu.Unlock()
+		defer func() {
+			downloadsMu.Lock()
+			delete(downloads, torrentFile)
+			downloadsMu.Unlock()
+		}()
+		if peers.connect() == 0 {
+			return errors.New("no available active peers found")
 		}
+		go peers.run()
 
-		// Wait for workers to complete
+		// Progress goes to the subscribers of SubscribeProgress
+		progress := newProgressTracker(torrentFile, torrentHash, pieces, have.Has)
+		progress.peerRates = peers.rates
+		stopProgress := make(chan struct{})
+		progressDone := make(chan struct{})
 		go func() {
-			wg.Wait()
-			close(results)
+			defer close(progressDone)
+			progress.run(stopProgress)
 		}()
 
-		// Collect results and merge file
-		piecesByIndex := make(map[int][]byte)
+		// Workers only report verified pieces, or pieces given up
 		for result := range results {
 			if result.Error != nil {
-				fmt.Printf("Error downloading piece %d: %v\n", result.Index, result.Error)
+				if ctx.Err() == nil {
+					fmt.Printf("Error downloading piece %d: %v\n", result.Index, result.Error)
+				}
 				continue
 			}
-			piecesByIndex[result.Index] = result.Data
-
-			calculatedHash := sha1.Sum(result.Data)
-			if !bytes.Equal(calculatedHash[:], tf.PieceHashes[result.Index][:]) {
-				fmt.Printf("Piece %d hash mismatch!\n", result.Index)
+			if err := partial.Put(result.Index, result.Data); err != nil {
+				fmt.Printf("Error saving piece %d: %v\n", result.Index, err)
+				continue
 			}
-			fmt.Printf("Successfully downloaded piece %d of %s\n", result.Index, tf.Name)
+			progress.piece(result.Index)
 		}
+		close(stopProgress)
+		<-progressDone
+	}
 
-		// Merge pieces into current file
-		if err := tf.MergePieces(tf.Name, piecesByIndex); err != nil {
-			fmt.Printf("Error merging pieces for %s: %v\n", tf.Name, err)
+	complete := true
+	have = partial.Bitfield()
+	for f, tf := range tfs {
+		if !partial.FileComplete(f) {
+			got := 0
+			for i, piece := range pieces {
+				if piece.File == f && have.Has(i) {
+					got++
+				}
+			}
+			fmt.Printf("Download of %s incomplete with %d/%d pieces, download again to resume\n", tf.Name, got, len(tf.PieceHashes))
+			complete = false
+			continue
+		}
+		// The partial file becomes the data file
+		if _, err := partial.FinishFile(f); err != nil {
+			fmt.Printf("Error finishing %s: %v\n", tf.Name, err)
+			complete = false
 			continue // Continue with next file even if current fails
 		}
 
 		fmt.Printf("Download complete for file: %s\n", tf.Name)
 		trackerAddress := tf.Announce
-		torrent.Create([]string{tf.Name}, trackerAddress)
+		torrent.CreateWithSwarmKey([]string{tf.Name}, trackerAddress, tf.SwarmKey)
 
-		err = ConnectToTracker(trackerAddress, peerAddress, tf.Name)
+		// A cancelled download still announces what it completed
+		announceCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), trackerTimeout)
+		err = ConnectToTracker(announceCtx, trackerAddress, peerAddress, tf.Name)
+		cancel()
 		if err != nil {
 			fmt.Printf("Failed to connect to tracker: %v\n", err)
 		}
-		exist := false
-		for _, tracker := range connectedTrackerAddresses {
-			if tracker.Addr == trackerAddress && tracker.Filename == tf.Name {
-				exist = true
-				break
-			}
-		}
-		if !exist {
-			connectedTrackerAddresses = append(connectedTrackerAddresses, AddrAndFilename{Addr: trackerAddress, Filename: tf.Name})
-		}
+		rememberTracker(trackerAddress, tf.Name)
 	}
-
-	fmt.Println("All downloads complete!")
-}
-
-func downloadWorker(peer string, work <-chan PieceWork, results chan<- PieceResult, infoHash []byte) {
-	for piece := range work {
-		fmt.Printf("Downloading piece %d from peer %s\n", piece.Index, peer)
-		data, err := requestPieceFromPeer(peer, piece.Index, infoHash)
-
-		results <- PieceResult{
-			Index: piece.Index,
-			Data:  data,
-			Error: err,
+	// From now on the files themselves are served, their pieces were all
+	// verified on arrival
+	if complete {
+		if err := partial.Finish(); err != nil {
+			return fmt.Errorf("error finishing download: %v", err)
 		}
 	}
-}
 
-func requestPieceFromPeer(address string, pieceIndex int, infoHash []byte) ([]byte, error) {
-	conn, err := net.DialTimeout("tcp", address, 60*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to peer: %v", err)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	defer conn.Close()
-
-	// First perform handshake if not already done
-	if err := performHandshake(address, infoHash); err != nil {
-		return nil, fmt.Errorf("handshake failed: %v", err)
+	if !complete {
+		have = partial.Bitfield()
+		return fmt.Errorf("download incomplete with %d/%d pieces", have.Count(), len(pieces))
 	}
-
-	// Request the piece
-	message := fmt.Sprintf("Requesting:%x:%d\n", infoHash, pieceIndex)
-	if _, err := conn.Write([]byte(message)); err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
-	}
-
-	// Read the piece size first (8 bytes)
-	sizeHeader := make([]byte, 8)
-	if _, err := io.ReadFull(conn, sizeHeader); err != nil {
-		return nil, fmt.Errorf("error reading piece size: %v", err)
-	}
-	pieceSize := binary.BigEndian.Uint64(sizeHeader)
-
-	// Read the exact number of bytes for the piece
-	data := make([]byte, pieceSize)
-	if _, err := io.ReadFull(conn, data); err != nil {
-		return nil, fmt.Errorf("error reading piece data: %v", err)
-	}
-
-	return data, nil
+	fmt.Println("All downloads complete!")
+	return nil
 }
 
-func TestConnection(address string) error {
-	// Set timeout for the entire operation
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+func TestConnection(ctx context.Context, address string) error {
+	conn, err := dial(ctx, address)
 	if err != nil {
-		return fmt.Errorf("connection failed: %v", err)
+		return err
 	}
 	defer conn.Close()
 
 	// Set read/write deadlines
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.SetDeadline(deadline(ctx, 5*time.Second))
+	defer abortOnDone(ctx, conn)()
 
 	// Send a test message
 	_, err = conn.Write([]byte("test:\n")) // Add newline as message delimiter
 	if err != nil {
-		return fmt.Errorf("failed to send test message: %v", err)
+		return ctxErr(ctx, fmt.Errorf("failed to send test message: %v", err))
 	}
 
 	// Read response
 	reader := bufio.NewReader(conn)
 	response, err := reader.ReadString('\n')
 	if err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
+		return ctxErr(ctx, fmt.Errorf("failed to read response: %v", err))
 	}
 
 	fmt.Printf("Received response: %s", response)
 	return nil
 }
 
-func performHandshake(address string, infoHash []byte) error {
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-	if err != nil {
-		return fmt.Errorf("handshake connection failed: %v", err)
-	}
-	defer conn.Close()
-
-	// Send handshake message
-	handshakeMsg := fmt.Sprintf("HANDSHAKE:%x\n", infoHash)
-	if _, err := conn.Write([]byte(handshakeMsg)); err != nil {
-		return fmt.Errorf("failed to send handshake: %v", err)
-	}
-
-	// Read handshake response
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read handshake response: %v", err)
-	}
-
-	if response != "OK\n" {
-		return fmt.Errorf("invalid handshake response: %s", response)
-	}
-
-	return nil
-}
-func AnnounceToTracker(peerAddress string, torrentFilename string) error {
+func AnnounceToTracker(ctx context.Context, peerAddress string, torrentFilename string) error {
 	tfs, err := torrent.Open("torrent_files/" + torrentFilename)
 	if err != nil {
 		fmt.Printf("Error opening torrent file: %v\n", err)
@@ -270,32 +358,24 @@ func AnnounceToTracker(peerAddress string, torrentFilename string) error {
 	for _, tf := range tfs {
 		trackerAddress = tf.Announce
 		filename = tf.Name
-		err := ConnectToTracker(trackerAddress, peerAddress, filename)
+		err := ConnectToTracker(ctx, trackerAddress, peerAddress, filename)
 		if err != nil {
 			fmt.Printf("Failed to connect to tracker %s for file %s: (error %v)\n", trackerAddress, filename, err)
 			return err
 		}
-		exist := false
-		for _, tracker := range connectedTrackerAddresses {
-			if tracker.Addr == trackerAddress && tracker.Filename == filename {
-				fmt.Println("You are already connected to this tracker for this file")
-				exist = true
-				break
-			}
-		}
-		if !exist {
-			connectedTrackerAddresses = append(connectedTrackerAddresses, AddrAndFilename{Addr: trackerAddress, Filename: filename})
+		if !rememberTracker(trackerAddress, filename) {
+			fmt.Println("You are already connected to this tracker for this file")
 		}
 	}
 	return nil
 }
 
-func ConnectToTracker(trackerAddress string, peerAddress string, filename string) error {
-	conn, err := net.Dial("tcp", trackerAddress)
+func ConnectToTracker(ctx context.Context, trackerAddress string, peerAddress string, filename string) error {
+	conn, done, err := trackerConn(ctx, trackerAddress)
 	if err != nil {
-		return fmt.Errorf("connection failed: %v", err)
+		return err
 	}
-	defer conn.Close()
+	defer done()
 
 	fmt.Printf("Connected to tracker %s for file %s\n", trackerAddress, filename)
 
@@ -305,17 +385,17 @@ func ConnectToTracker(trackerAddress string, peerAddress string, filename string
 
 	// Gửi message đến tracker
 	if _, err := conn.Write([]byte(message)); err != nil {
-		return fmt.Errorf("failed to send data: %v", err)
+		return ctxErr(ctx, fmt.Errorf("failed to send data: %v", err))
 	}
 	return nil
 }
 
-func GetListOfPeersForAFile(trackerAddress string, filename string) error {
-	conn, err := net.Dial("tcp", trackerAddress)
+func GetListOfPeersForAFile(ctx context.Context, trackerAddress string, filename string) error {
+	conn, done, err := trackerConn(ctx, trackerAddress)
 	if err != nil {
-		return fmt.Errorf("connection failed: %v", err)
+		return err
 	}
-	defer conn.Close()
+	defer done()
 
 	// Tạo message để gửi
 	// Format: LIST:{fileName}
@@ -323,40 +403,83 @@ func GetListOfPeersForAFile(trackerAddress string, filename string) error {
 
 	// Gửi message đến tracker
 	if _, err := conn.Write([]byte(message)); err != nil {
-		return fmt.Errorf("failed to send data: %v", err)
+		return ctxErr(ctx, fmt.Errorf("failed to send data: %v", err))
 	}
 
 	// Đọc phản hồi từ tracker
 	reader := bufio.NewReader(conn)
 	response, err := reader.ReadString('!')
-	response = response[:len(response)-1] // Remove the last character (!)
 	if err != nil {
-		return fmt.Errorf("failed to read tracker response: %v", err)
+		return ctxErr(ctx, fmt.Errorf("failed to read tracker response: %v", err))
 	}
+	response = response[:len(response)-1] // Remove the last character (!)
 
 	fmt.Printf("Tracker response: %s\n", response)
 	return nil
 }
 
-func DisconnectToTracker(peerAddress string) error {
-	for _, tracker := range connectedTrackerAddresses {
-		conn, err := net.Dial("tcp", tracker.Addr)
-		if err != nil {
-			return fmt.Errorf("connection failed: %v", err)
-		}
-		defer conn.Close()
+// GetPeers asks a tracker which peers announced a file
+func GetPeers(ctx context.Context, trackerAddress string, filename string) ([]string, error) {
+	conn, done, err := trackerConn(ctx, trackerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// Format: LIST:{fileName}
+	if _, err := conn.Write([]byte(fmt.Sprintf("LIST:%s", filename))); err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("failed to send data: %v", err))
+	}
 
-		// Tạo message để gửi
-		// Format: STOP:{peerAddress}
-		message := fmt.Sprintf("STOP:%s", peerAddress)
+	// The tracker answers LIST:{fileName}:[{peer} {peer} ...] then '!'
+	response, err := bufio.NewReader(conn).ReadString('!')
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("failed to read tracker response: %v", err))
+	}
+	start := strings.LastIndex(response, ":[")
+	end := strings.LastIndex(response, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("malformed tracker response: %s", response)
+	}
+	return strings.Fields(response[start+2 : end]), nil
+}
 
-		// Gửi message đến tracker
-		if _, err := conn.Write([]byte(message)); err != nil {
-			return fmt.Errorf("failed to send data: %v", err)
+// DisconnectToTracker sends STOP to every tracker we announced to. A tracker
+// that cannot be reached does not keep the others from being told.
+func DisconnectToTracker(ctx context.Context, peerAddress string) error {
+	var errs []error
+	stopped := make(map[string]bool)
+	for _, tracker := range GetListOfTrackers() {
+		if stopped[tracker.Addr] {
+			continue
 		}
+		stopped[tracker.Addr] = true
+		if err := stopTracker(ctx, tracker.Addr, peerAddress); err != nil {
+			errs = append(errs, fmt.Errorf("tracker %s: %v", tracker.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stopTracker(ctx context.Context, trackerAddress string, peerAddress string) error {
+	conn, done, err := trackerConn(ctx, trackerAddress)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// Tạo message để gửi
+	// Format: STOP:{peerAddress}
+	message := fmt.Sprintf("STOP:%s", peerAddress)
+
+	// Gửi message đến tracker
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return ctxErr(ctx, fmt.Errorf("failed to send data: %v", err))
 	}
 	return nil
 }
 func GetListOfTrackers() []AddrAndFilename {
-	return connectedTrackerAddresses
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	return append([]AddrAndFilename(nil), connectedTrackerAddresses...)
 }
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The request depth is adapted to each peer by default, starting at
+// pipelineDepth. Fixed, every peer gets pipelineDepth.
+var (
+	pipelineMu       sync.Mutex
+	pipelineDepth    = 5 // block requests a worker keeps in flight on its session
+	adaptivePipeline = true
+)
+
+// Pipeline returns the request depth and whether it adapts to each peer
+func Pipeline() (int, bool) {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	return pipelineDepth, adaptivePipeline
+}
+
+// SetPipelineDepth gives every peer a fixed request depth, running downloads
+// included
+func SetPipelineDepth(depth int) {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	pipelineDepth, adaptivePipeline = depth, false
+}
+
+// SetAdaptivePipeline lets the request depth of each peer follow its measured
+// throughput and latency again
+func SetAdaptivePipeline() {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	adaptivePipeline = true
+}
+
+// Bounds of an adapted request depth
+const (
+	minPipelineDepth = 2
+	maxPipelineDepth = 64
+	rateWindow       = time.Second            // throughput is sampled over this
+	requestQueueTime = 250 * time.Millisecond // of blocks queued at the peer beyond the round trip
+)
+
+// requestDepth measures the blocks a peer delivers and derives how many
+// requests to keep in flight: enough to cover the bandwidth-delay product of
+// the session, plus requestQueueTime worth of blocks so the peer never waits
+// on us. The latency is the lowest round trip seen, the time blocks spend
+// queued behind our own requests would otherwise make the depth grow without
+// end.
+type requestDepth struct {
+	mu          sync.Mutex
+	depth       int
+	rate        float64       // bytes per second, smoothed
+	latency     time.Duration // base round trip of a block request
+	windowStart time.Time
+	windowBytes int
+}
+
+func newRequestDepth() *requestDepth {
+	depth, _ := Pipeline()
+	return &requestDepth{depth: depth}
+}
+
+// received records a block that took rtt from request to arrival
+func (d *requestDepth) received(bytes int, rtt time.Duration) {
+	if bytes == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.latency == 0 || rtt < d.latency {
+		d.latency = rtt
+	}
+
+	if d.windowStart.IsZero() {
+		d.windowStart = now.Add(-rtt)
+	}
+	d.windowBytes += bytes
+	elapsed := now.Sub(d.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(d.windowBytes) / elapsed.Seconds()
+	if d.rate == 0 {
+		d.rate = sample
+	} else {
+		d.rate = 0.7*d.rate + 0.3*sample
+	}
+	d.windowStart, d.windowBytes = now, 0
+
+	// In blocks of the size the peer just sent
+	d.depth = int(math.Ceil(d.rate * (d.latency + requestQueueTime).Seconds() / float64(bytes)))
+	d.depth = max(minPipelineDepth, min(d.depth, maxPipelineDepth))
+}
+
+// idle restarts the throughput sample, time without requests in flight says
+// nothing about the peer
+func (d *requestDepth) idle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.windowStart, d.windowBytes = time.Time{}, 0
+}
+
+func (d *requestDepth) current() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.depth
+}
+
+// stats returns the smoothed throughput in bytes per second and the base
+// latency. A peer that stopped delivering is not credited with its old rate.
+func (d *requestDepth) stats() (float64, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.windowStart.IsZero() {
+		if elapsed := time.Since(d.windowStart); elapsed > 2*rateWindow {
+			return min(d.rate, float64(d.windowBytes)/elapsed.Seconds()), d.latency
+		}
+	}
+	return d.rate, d.latency
+}
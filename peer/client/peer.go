@@ -0,0 +1,643 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/blocklist"
+	"tcp-app/picker"
+	"tcp-app/ratelimit"
+	"tcp-app/storage"
+	"tcp-app/swarm"
+	"tcp-app/wire"
+)
+
+// BlockSize is how much of a piece one request asks for
+const BlockSize = 16 * 1024
+
+// peerIdleLimit is how long a worker waits for its peer to get a piece we need
+const peerIdleLimit = 2 * time.Minute
+
+// handshakeTimeout bounds setting up a session, key exchange and handshake
+// each
+const handshakeTimeout = 5 * time.Second
+
+// writeTimeout bounds sending one message to a peer
+const writeTimeout = 10 * time.Second
+
+// Keepalives, for peers that negotiated them
+const (
+	keepaliveInterval = 30 * time.Second
+	peerSilenceLimit  = 2 * time.Minute // a peer sending nothing for this long is gone
+)
+
+// peerConn is a session with one peer for one torrent. The handshake is done
+// on the connection itself, then block requests are pipelined over it. A
+// reader goroutine keeps track of the pieces the peer announces and passes
+// the replies to the worker.
+type peerConn struct {
+	address   string
+	infoHash  []byte
+	numPieces int
+	conn      net.Conn
+	reader    *bufio.Reader
+	broken    bool            // a write failed, only touched by the worker
+	ext       wire.Extensions // what was agreed in the extension handshake
+	depth     *requestDepth
+	stats     *peerStats  // of the peer for the whole download
+	unwatch   func() bool // stops closing the session when the download is cancelled
+
+	mu        sync.Mutex
+	have      storage.Bitfield
+	avail     *picker.Availability // counts the pieces of the peer until it is removed
+	requested map[blockRequest]int // requests sent and not answered yet, cancelled ones included
+
+	messages   chan peerMessage
+	haveNews   chan struct{} // signalled when the peer announces a piece
+	done       chan struct{} // closed when the reader stops
+	workerDone chan struct{} // closed when the worker returns, nobody takes messages after
+	err        error         // why the reader stopped, valid once done is closed
+}
+
+// peerMessage is a reply to one of our block requests
+type peerMessage struct {
+	kind string // PIECE, CHOKED or REJECT
+	req  blockRequest
+	data []byte
+}
+
+// dialPeer connects to a peer and binds the connection to the torrent. For a
+// torrent with a swarm key the connection is encrypted before the torrent is
+// named. The session is closed once ctx is done.
+func dialPeer(ctx context.Context, address string, infoHash []byte, numPieces int, swarmKey string, avail *picker.Availability) (*peerConn, error) {
+	if r, blocked := blocklist.Default.Blocked(address); blocked {
+		return nil, fmt.Errorf("address is blocked (%s)", r)
+	}
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if swarmKey != "" {
+		conn.SetDeadline(deadline(ctx, handshakeTimeout))
+		stop := abortOnDone(ctx, conn)
+		secure, err := swarm.Client(conn, swarmKey)
+		stop()
+		if err != nil {
+			conn.Close()
+			return nil, ctxErr(ctx, fmt.Errorf("key exchange failed: %v", err))
+		}
+		conn.SetDeadline(time.Time{})
+		conn = secure
+	}
+	pc := &peerConn{
+		address:    address,
+		infoHash:   infoHash,
+		numPieces:  numPieces,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		depth:      newRequestDepth(),
+		requested:  make(map[blockRequest]int),
+		messages:   make(chan peerMessage, 64),
+		haveNews:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		workerDone: make(chan struct{}),
+	}
+	if err := performHandshake(ctx, pc); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+	pc.unwatch = context.AfterFunc(ctx, func() { conn.Close() })
+	pc.avail = avail
+	avail.AddPeer(pc.have.Has)
+	go pc.readLoop()
+	if pc.ext.Supports("KEEPALIVE") {
+		go pc.keepAlive()
+	}
+	return pc, nil
+}
+
+// keepAlive tells the peer we are still there while the worker has nothing
+// to ask, so the session is not closed as idle
+func (pc *peerConn) keepAlive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pc.conn.SetWriteDeadline(time.Now().Add(keepaliveInterval))
+			pc.conn.Write([]byte("KEEPALIVE\n"))
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+func (pc *peerConn) Close() error {
+	if pc.unwatch != nil {
+		pc.unwatch()
+	}
+	return pc.conn.Close()
+}
+
+// forget stops counting the pieces of the peer in the availability
+func (pc *peerConn) forget() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.avail != nil {
+		pc.avail.RemovePeer(pc.have.Has)
+		pc.avail = nil
+	}
+}
+
+// Has reports whether the peer holds a piece
+func (pc *peerConn) Has(index int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.have.Has(index)
+}
+
+// performHandshake binds the session to the torrent and reads what the peer
+// holds. It gives up when ctx is done.
+func performHandshake(ctx context.Context, pc *peerConn) error {
+	pc.conn.SetDeadline(deadline(ctx, handshakeTimeout))
+	stop := abortOnDone(ctx, pc.conn)
+	defer func() {
+		if stop() {
+			pc.conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	// Send handshake message, our extension handshake goes right behind it
+	handshakeMsg := fmt.Sprintf("HANDSHAKE:%x\n", pc.infoHash) + clientExtensions.Message()
+	if _, err := pc.conn.Write([]byte(handshakeMsg)); err != nil {
+		return fmt.Errorf("failed to send handshake: %v", err)
+	}
+
+	// Read handshake response
+	response, err := pc.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read handshake response: %v", err)
+	}
+
+	if response != "OK\n" {
+		return fmt.Errorf("invalid handshake response: %s", response)
+	}
+
+	// The peer follows with the pieces it holds
+	line, err := pc.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read bitfield: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "BITFIELD:") {
+		return fmt.Errorf("expected bitfield, got: %s", line)
+	}
+	have, err := storage.ParseBitfield(strings.TrimPrefix(line, "BITFIELD:"), pc.numPieces)
+	if err != nil {
+		return err
+	}
+	pc.have = have
+
+	// A peer without extensions answers ours with an error. Pieces it
+	// announces in the meantime are recorded.
+	for {
+		line, err := pc.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read extension handshake: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "HAVE:"):
+			index, err := strconv.Atoi(strings.TrimPrefix(line, "HAVE:"))
+			if err != nil {
+				return fmt.Errorf("malformed message from peer: %s", line)
+			}
+			pc.have.Set(index)
+		case strings.HasPrefix(line, "EXTENDED:"):
+			remote, err := wire.ParseExtensions(line)
+			if err != nil {
+				return err
+			}
+			pc.ext = wire.Negotiate(clientExtensions, remote)
+			return nil
+		case strings.HasPrefix(line, "ERROR:"):
+			pc.ext = wire.Base()
+			return nil
+		default:
+			return fmt.Errorf("expected extension handshake, got: %s", line)
+		}
+	}
+}
+
+// clientExtensions is what we advertise when dialing a peer
+var clientExtensions = wire.Local(wire.Messages, 0, 0)
+
+// pipelineDepth is how many block requests may be outstanding on the session
+func (pc *peerConn) pipelineDepth() int {
+	depth, adaptive := Pipeline()
+	if adaptive {
+		depth = pc.depth.current()
+	}
+	if pc.ext.MaxRequests > 0 && pc.ext.MaxRequests < depth {
+		return pc.ext.MaxRequests
+	}
+	return depth
+}
+
+// blockSize is how much one request asks for, within the peer's limit
+func (pc *peerConn) blockSize() int {
+	if pc.ext.MaxBlock > 0 && pc.ext.MaxBlock < BlockSize {
+		return pc.ext.MaxBlock
+	}
+	return BlockSize
+}
+
+// readLoop reads everything the peer sends until the connection ends
+func (pc *peerConn) readLoop() {
+	defer close(pc.done)
+	for {
+		// A peer sending keepalives is gone when it falls silent
+		if pc.ext.Supports("KEEPALIVE") {
+			pc.conn.SetReadDeadline(time.Now().Add(peerSilenceLimit))
+		}
+		line, err := pc.reader.ReadString('\n')
+		if err != nil {
+			pc.err = fmt.Errorf("error reading from peer: %v", err)
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "KEEPALIVE" {
+			continue
+		}
+		if strings.HasPrefix(line, "ERROR:") {
+			// The peer closes the session and says why
+			pc.err = fmt.Errorf("peer closed the session: %s", strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+			return
+		}
+
+		if strings.HasPrefix(line, "HAVE:") {
+			index, err := strconv.Atoi(strings.TrimPrefix(line, "HAVE:"))
+			if err != nil {
+				pc.err = fmt.Errorf("malformed message from peer: %s", line)
+				return
+			}
+			pc.mu.Lock()
+			if !pc.have.Has(index) {
+				pc.have.Set(index)
+				if pc.avail != nil {
+					pc.avail.Have(index)
+				}
+			}
+			pc.mu.Unlock()
+			select {
+			case pc.haveNews <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		msg, err := pc.readBlockFromPeer(line)
+		if err != nil {
+			pc.err = err
+			return
+		}
+		select {
+		case pc.messages <- msg:
+		case <-pc.workerDone:
+			return
+		}
+	}
+}
+
+// readBlockFromPeer parses a reply to a block request. The header of a
+// PIECE carries the block size and is followed by the data.
+func (pc *peerConn) readBlockFromPeer(line string) (peerMessage, error) {
+	parts := strings.Split(line, ":")
+	if len(parts) != 4 {
+		return peerMessage{}, fmt.Errorf("unexpected message from peer: %s", line)
+	}
+	msg := peerMessage{kind: parts[0]}
+	if _, err := fmt.Sscanf(strings.Join(parts[1:], " "), "%d %d %d", &msg.req.index, &msg.req.begin, &msg.req.length); err != nil {
+		return peerMessage{}, fmt.Errorf("malformed message from peer: %s", line)
+	}
+	// Only replies to our own requests are accepted, so the peer cannot make
+	// us read a block of any other size
+	pc.mu.Lock()
+	asked := pc.requested[msg.req]
+	if asked > 1 {
+		pc.requested[msg.req]--
+	} else {
+		delete(pc.requested, msg.req)
+	}
+	pc.mu.Unlock()
+	if asked == 0 {
+		return peerMessage{}, fmt.Errorf("reply to a block we did not request: %s", line)
+	}
+	if msg.kind != "PIECE" {
+		return msg, nil
+	}
+
+	deadline := time.Now().Add(pieceReadTimeout)
+	pc.conn.SetReadDeadline(deadline)
+	defer pc.conn.SetReadDeadline(time.Time{})
+
+	msg.data = make([]byte, msg.req.length)
+	throttled := &ratelimit.Reader{
+		R:        pc.reader,
+		Limiters: DownloadLimits.Limiters(fmt.Sprintf("%x", pc.infoHash)),
+		Deadline: deadline,
+	}
+	if _, err := io.ReadFull(throttled, msg.data); err != nil {
+		return peerMessage{}, fmt.Errorf("error reading piece data: %v", err)
+	}
+	recordDownloaded(pc.address, len(msg.data))
+	return msg, nil
+}
+
+// blockRequest addresses length bytes at offset begin of a piece
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func (r blockRequest) String() string {
+	return fmt.Sprintf("%d:%d:%d", r.index, r.begin, r.length)
+}
+
+// pieceProgress collects the blocks of one piece
+type pieceProgress struct {
+	work     PieceWork
+	buf      []byte
+	pending  []blockRequest // not requested yet
+	received int
+}
+
+func newPieceProgress(work PieceWork, blockSize int) *pieceProgress {
+	p := &pieceProgress{
+		work: work,
+		buf:  make([]byte, work.Size),
+	}
+	for begin := 0; begin < int(work.Size); begin += blockSize {
+		length := blockSize
+		if begin+length > int(work.Size) {
+			length = int(work.Size) - begin
+		}
+		p.pending = append(p.pending, blockRequest{index: work.Index, begin: begin, length: length})
+	}
+	return p
+}
+
+// requestPieceFromPeer asks for one block without waiting for the reply
+func requestPieceFromPeer(ctx context.Context, pc *peerConn, req blockRequest) error {
+	pc.mu.Lock()
+	pc.requested[req]++
+	pc.mu.Unlock()
+	pc.conn.SetWriteDeadline(deadline(ctx, writeTimeout))
+	if _, err := pc.conn.Write([]byte(fmt.Sprintf("REQUEST:%s\n", req))); err != nil {
+		pc.broken = true
+		return ctxErr(ctx, fmt.Errorf("error sending request: %v", err))
+	}
+	return nil
+}
+
+// cancelRequest tells the peer we no longer need a block
+func cancelRequest(pc *peerConn, req blockRequest) {
+	if !pc.ext.Supports("CANCEL") {
+		return
+	}
+	pc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := pc.conn.Write([]byte(fmt.Sprintf("CANCEL:%s\n", req))); err != nil {
+		pc.broken = true
+	}
+}
+
+// downloadWorker takes pieces the peer holds from the queue, keeps up to
+// pipelineDepth block requests outstanding on the session and reassembles
+// the blocks into pieces. Blocks the peer choked are requested again after
+// a pause. Once ctx is cancelled the unfinished pieces are given up right
+// away; what was verified is already stored.
+func downloadWorker(ctx context.Context, pc *peerConn, queue *pieceQueue, results chan<- PieceResult) {
+	defer close(pc.workerDone)
+	active := make(map[int]*pieceProgress)
+	var order []int                                 // active pieces, oldest first
+	outstanding := make(map[blockRequest]time.Time) // when each was requested
+	var chokedSince, pausedUntil time.Time
+	idleSince := time.Now()
+
+	done := func(index int) {
+		delete(active, index)
+		for i, idx := range order {
+			if idx == index {
+				order = append(order[:i], order[i+1:]...)
+				break
+			}
+		}
+	}
+	// cancelBlocks cancels the blocks of a piece still in flight
+	cancelBlocks := func(index int) {
+		for req := range outstanding {
+			if req.index == index {
+				delete(outstanding, req)
+				if !pc.broken && ctx.Err() == nil {
+					cancelRequest(pc, req)
+				}
+			}
+		}
+	}
+	// fail puts a piece back in the queue for another peer, or gives it up
+	// once it failed too often
+	fail := func(p *pieceProgress, err error) {
+		done(p.work.Index)
+		if ctx.Err() == nil {
+			pc.stats.failed(errors.Is(err, errHashMismatch))
+		}
+		if ctx.Err() == nil && queue.retry(p.work, pc.address) {
+			if !queue.isComplete(p.work.Index) {
+				fmt.Printf("Retrying piece %d, failed with peer %s: %v\n", p.work.Index, pc.address, err)
+			}
+			return
+		}
+		if ctx.Err() == nil {
+			err = fmt.Errorf("giving up after %d attempts, last error: %v", maxPieceAttempts, err)
+		}
+		results <- PieceResult{Index: p.work.Index, Error: err, Peer: pc.address}
+	}
+	// finish checks a complete piece, only verified pieces are handed on and
+	// only the first copy of a piece downloaded in the endgame
+	finish := func(p *pieceProgress) {
+		hash := sha1.Sum(p.buf)
+		if !bytes.Equal(hash[:], p.work.Hash) {
+			fmt.Printf("Peer %s sent piece %d with a wrong hash\n", pc.address, p.work.Index)
+			if blocklist.Default.HashFailed(pc.address) {
+				fmt.Printf("Banned peer %s after %d bad pieces\n", pc.address, blocklist.MaxHashFailures+1)
+				pc.Close()
+				pc.broken = true
+			}
+			fail(p, errHashMismatch)
+			return
+		}
+		done(p.work.Index)
+		pc.stats.verified()
+		if queue.complete(p.work.Index, pc.address) {
+			results <- PieceResult{Index: p.work.Index, Data: p.buf, Peer: pc.address}
+		}
+	}
+	// abandon gives up on a piece and cancels its blocks still in flight
+	abandon := func(index int, err error) {
+		cancelBlocks(index)
+		fail(active[index], err)
+	}
+	// dropCompleted cancels the pieces another peer completed first
+	dropCompleted := func() {
+		for _, index := range append([]int(nil), order...) {
+			if queue.isComplete(index) {
+				cancelBlocks(index)
+				queue.cancel(index, pc.address)
+				done(index)
+			}
+		}
+	}
+	nextBlock := func() (blockRequest, bool) {
+		if ctx.Err() != nil {
+			return blockRequest{}, false
+		}
+		for _, index := range order {
+			p := active[index]
+			if len(p.pending) > 0 {
+				req := p.pending[0]
+				p.pending = p.pending[1:]
+				return req, true
+			}
+		}
+		// A slow peer works on one piece at a time, the others go to the
+		// fast peers
+		if len(order) > 0 && pc.stats.isSlow() {
+			return blockRequest{}, false
+		}
+		piece, ok := queue.take(pc.address, pc.Has)
+		if !ok {
+			return blockRequest{}, false
+		}
+		p := newPieceProgress(piece, pc.blockSize())
+		active[piece.Index] = p
+		order = append(order, piece.Index)
+		req := p.pending[0]
+		p.pending = p.pending[1:]
+		return req, true
+	}
+
+	for {
+		// Keep the pipeline full unless the peer is choking us
+		for !pc.broken && len(outstanding) < pc.pipelineDepth() && time.Now().After(pausedUntil) {
+			req, ok := nextBlock()
+			if !ok {
+				break
+			}
+			if err := requestPieceFromPeer(ctx, pc, req); err != nil {
+				break
+			}
+			if len(outstanding) == 0 {
+				pc.depth.idle()
+			}
+			outstanding[req] = time.Now()
+		}
+		if pc.broken {
+			for len(order) > 0 {
+				abandon(order[0], fmt.Errorf("peer %s is unavailable", pc.address))
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			for len(order) > 0 {
+				abandon(order[0], errors.New("download cancelled"))
+			}
+			return
+		}
+		if len(order) == 0 {
+			if queue.empty() {
+				return
+			}
+			// The peer has none of the pieces left, wait for it to announce some
+			if time.Since(idleSince) > peerIdleLimit {
+				return
+			}
+		} else {
+			idleSince = time.Now()
+		}
+
+		wait := time.Second
+		if len(outstanding) > 0 {
+			wait = pieceReadTimeout
+		} else if until := time.Until(pausedUntil); until > 0 {
+			wait = until
+		}
+		completions := queue.completions()
+		timer := time.NewTimer(wait)
+		select {
+		case msg := <-pc.messages:
+			timer.Stop()
+			sent, ok := outstanding[msg.req]
+			if !ok {
+				// Cancelled or never asked for
+				continue
+			}
+			delete(outstanding, msg.req)
+			p := active[msg.req.index]
+
+			switch msg.kind {
+			case "PIECE":
+				chokedSince = time.Time{}
+				pc.depth.received(len(msg.data), time.Since(sent))
+				copy(p.buf[msg.req.begin:], msg.data)
+				p.received += len(msg.data)
+				if p.received == len(p.buf) {
+					finish(p)
+				}
+			case "CHOKED":
+				if chokedSince.IsZero() {
+					chokedSince = time.Now()
+				}
+				if time.Since(chokedSince) > chokeWaitLimit {
+					abandon(msg.req.index, errChoked)
+					continue
+				}
+				p.pending = append([]blockRequest{msg.req}, p.pending...)
+				pausedUntil = time.Now().Add(chokeRetryDelay)
+			default:
+				abandon(msg.req.index, fmt.Errorf("peer %s rejected block %s", pc.address, msg.req))
+			}
+		case <-pc.haveNews:
+			timer.Stop()
+		case <-completions:
+			timer.Stop()
+			dropCompleted()
+		case <-ctx.Done():
+			timer.Stop()
+		case <-pc.done:
+			timer.Stop()
+			fmt.Printf("Lost peer %s: %v\n", pc.address, pc.err)
+			pc.broken = true
+		case <-timer.C:
+			if len(outstanding) > 0 {
+				fmt.Printf("Peer %s stopped answering\n", pc.address)
+				pc.Close()
+				pc.broken = true
+			}
+		}
+	}
+}
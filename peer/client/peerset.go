@@ -0,0 +1,311 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"tcp-app/torrent"
+)
+
+// Peer discovery during a download
+const (
+	peerRefreshInterval = 30 * time.Second // how often the tracker is asked again
+	noPeersLimit        = 2 * time.Minute  // a download without any peer for this long gives up
+	maxDownloadPeers    = 8                // sessions of one download
+)
+
+// peerSet is the peer sessions of one download. Peers come from the tracker
+// of the torrent and from the addresses given by the user, and the list is
+// refreshed while the download runs. Every session gets its own worker.
+// The peers are scored as they deliver: slow ones get one piece at a time,
+// and the slowest is dropped when the tracker knows peers we have not tried.
+type peerSet struct {
+	ctx      context.Context
+	tfs      []torrent.TorrentFile
+	infoHash []byte
+	self     string   // our own address, never dialed
+	extra    []string // given by the user
+	queue    *pieceQueue
+	results  chan PieceResult
+
+	mu     sync.Mutex
+	peers  map[string]*peerConn
+	stats  map[string]*peerStats // every peer of the download, by address
+	wg     sync.WaitGroup
+	exited chan struct{} // signalled when a worker returns
+}
+
+func newPeerSet(ctx context.Context, tfs []torrent.TorrentFile, infoHash []byte, self string, extra []string, queue *pieceQueue, results chan PieceResult) *peerSet {
+	return &peerSet{
+		ctx:      ctx,
+		tfs:      tfs,
+		infoHash: infoHash,
+		self:     self,
+		extra:    extra,
+		queue:    queue,
+		results:  results,
+		peers:    make(map[string]*peerConn),
+		stats:    make(map[string]*peerStats),
+		exited:   make(chan struct{}, 1),
+	}
+}
+
+// candidates returns the peers the trackers of the torrent know, followed by
+// the extra addresses
+func (ps *peerSet) candidates() []string {
+	var addresses []string
+	seen := map[string]bool{ps.self: true}
+	asked := make(map[AddrAndFilename]bool)
+	for _, tf := range ps.tfs {
+		// The tracker knows the peers of each file
+		key := AddrAndFilename{Addr: tf.Announce, Filename: tf.Name}
+		if asked[key] {
+			continue
+		}
+		asked[key] = true
+		peers, err := GetPeers(ps.ctx, tf.Announce, tf.Name)
+		if err != nil {
+			fmt.Printf("Failed to get peers from tracker %s: %v\n", tf.Announce, err)
+			continue
+		}
+		for _, peer := range peers {
+			if !seen[peer] {
+				seen[peer] = true
+				addresses = append(addresses, peer)
+			}
+		}
+	}
+	for _, peer := range ps.extra {
+		if !seen[peer] {
+			seen[peer] = true
+			addresses = append(addresses, peer)
+		}
+	}
+	return addresses
+}
+
+// connect dials the candidates we have no session with and starts their
+// workers. It returns the number of new sessions.
+func (ps *peerSet) connect() int {
+	return ps.connectTo(ps.candidates())
+}
+
+func (ps *peerSet) connectTo(addresses []string) int {
+	added := 0
+	numPieces := len(torrent.Pieces(ps.tfs))
+	for _, address := range addresses {
+		if ps.live() >= maxDownloadPeers {
+			break
+		}
+		if !ps.available(address) || ps.ctx.Err() != nil {
+			continue
+		}
+		fmt.Printf("Connecting to peer: %s\n", address)
+		pc, err := dialPeer(ps.ctx, address, ps.infoHash, numPieces, ps.tfs[0].SwarmKey, ps.queue.avail)
+		if err != nil {
+			if ps.ctx.Err() == nil {
+				fmt.Printf("Peer %s is not available: %v\n", address, err)
+			}
+			continue
+		}
+		fmt.Printf("Peer %s is available\n", address)
+		ps.mu.Lock()
+		pc.stats = ps.statsFor(address)
+		pc.stats.connected(pc.depth)
+		ps.peers[address] = pc
+		ps.wg.Add(1)
+		ps.mu.Unlock()
+		added++
+		go func() {
+			defer ps.wg.Done()
+			defer ps.remove(pc)
+			downloadWorker(ps.ctx, pc, ps.queue, ps.results)
+		}()
+	}
+	return added
+}
+
+// available reports whether we may dial a peer: it has no session and was
+// not dropped recently
+func (ps *peerSet) available(address string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, connected := ps.peers[address]; connected {
+		return false
+	}
+	stats, known := ps.stats[address]
+	if !known {
+		return true
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return time.Since(stats.dropped) > droppedCooldown
+}
+
+// statsFor returns the stats of a peer, ps.mu is held
+func (ps *peerSet) statsFor(address string) *peerStats {
+	stats, exists := ps.stats[address]
+	if !exists {
+		stats = &peerStats{}
+		ps.stats[address] = stats
+	}
+	return stats
+}
+
+// scores returns the scores of every peer of the download, best first
+func (ps *peerSet) scores() []PeerScore {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	scores := make([]PeerScore, 0, len(ps.stats))
+	for address, stats := range ps.stats {
+		score := stats.score(address)
+		_, score.Connected = ps.peers[address]
+		scores = append(scores, score)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	return scores
+}
+
+// rank marks the connected peers scoring far below the best as slow, and
+// replaces the worst of them when the tracker has a peer we have not tried
+func (ps *peerSet) rank() {
+	ps.mu.Lock()
+	var judged []PeerScore
+	best := 0.0
+	for address := range ps.peers {
+		stats := ps.stats[address]
+		stats.mu.Lock()
+		age := time.Since(stats.since)
+		stats.mu.Unlock()
+		if age < minPeerAge {
+			continue
+		}
+		score := stats.score(address)
+		judged = append(judged, score)
+		best = max(best, score.Score)
+	}
+	var slow []PeerScore
+	for _, score := range judged {
+		stats := ps.stats[score.Address]
+		stats.mu.Lock()
+		stats.slow = len(judged) > 1 && score.Score < best*slowPeerFraction
+		stats.mu.Unlock()
+		if stats.isSlow() {
+			slow = append(slow, score)
+		}
+	}
+	ps.mu.Unlock()
+	if len(slow) == 0 || ps.queue.empty() {
+		return
+	}
+
+	var fresh []string
+	for _, address := range ps.candidates() {
+		if ps.available(address) {
+			fresh = append(fresh, address)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+	worst := slow[0]
+	for _, score := range slow[1:] {
+		if score.Score < worst.Score {
+			worst = score
+		}
+	}
+	fmt.Printf("Dropping slow peer %s (%.1f KiB/s, best %.1f KiB/s) for a fresh one\n", worst.Address, worst.Rate/1024, best/1024)
+	ps.mu.Lock()
+	if pc, connected := ps.peers[worst.Address]; connected {
+		stats := ps.stats[worst.Address]
+		stats.mu.Lock()
+		stats.dropped = time.Now()
+		stats.mu.Unlock()
+		pc.Close()
+		// Its slot is free right away, the worker cleans up on its own
+		delete(ps.peers, worst.Address)
+	}
+	ps.mu.Unlock()
+	ps.connectTo(fresh)
+}
+
+// remove closes a session whose worker has returned
+func (ps *peerSet) remove(pc *peerConn) {
+	pc.Close()
+	pc.forget()
+	ps.mu.Lock()
+	if ps.peers[pc.address] == pc {
+		delete(ps.peers, pc.address)
+	}
+	ps.mu.Unlock()
+	select {
+	case ps.exited <- struct{}{}:
+	default:
+	}
+}
+
+// rates returns the download rate of each peer in bytes per second
+func (ps *peerSet) rates() map[string]float64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	rates := make(map[string]float64, len(ps.peers))
+	for address, pc := range ps.peers {
+		rates[address], _ = pc.depth.stats()
+	}
+	return rates
+}
+
+func (ps *peerSet) live() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.peers)
+}
+
+// run asks for new peers every peerRefreshInterval, and right away when the
+// last session ends, until every piece is taken and the workers are done. It
+// closes results when it returns.
+func (ps *peerSet) run() {
+	defer func() {
+		ps.wg.Wait()
+		close(ps.results)
+	}()
+	ticker := time.NewTicker(peerRefreshInterval)
+	defer ticker.Stop()
+	scoring := time.NewTicker(scoreInterval)
+	defer scoring.Stop()
+	alone := time.Time{} // since when we have no session
+	for {
+		if ps.live() == 0 {
+			if ps.queue.empty() || ps.ctx.Err() != nil {
+				return
+			}
+			if alone.IsZero() {
+				alone = time.Now()
+			} else if time.Since(alone) > noPeersLimit {
+				fmt.Println("No peers left for this download, giving up")
+				return
+			}
+		} else {
+			alone = time.Time{}
+		}
+		select {
+		case <-ps.ctx.Done():
+			// The workers give up their pieces and close their sessions
+			ps.wg.Wait()
+			return
+		case <-ticker.C:
+			if !ps.queue.empty() {
+				ps.connect()
+			}
+		case <-scoring.C:
+			ps.rank()
+		case <-ps.exited:
+			if ps.live() == 0 && !ps.queue.empty() {
+				ps.connect()
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"tcp-app/torrent"
+)
+
+// progressInterval is how often a running download publishes its progress
+// even when no piece completes
+const progressInterval = time.Second
+
+// Progress is a snapshot of a running download
+type Progress struct {
+	Torrent     string // torrent file name
+	InfoHash    string
+	PiecesDone  int
+	PiecesTotal int
+	BytesDone   int64
+	BytesTotal  int64
+	Rate        float64            // bytes per second over all peers
+	PeerRates   map[string]float64 // bytes per second of each peer
+	ETA         time.Duration      // 0 when the rate is not known yet
+	Done        bool               // the last event of the download, finished or not
+}
+
+// Percent returns the share of the bytes verified so far
+func (p Progress) Percent() float64 {
+	if p.BytesTotal == 0 {
+		return 100
+	}
+	return float64(p.BytesDone) * 100 / float64(p.BytesTotal)
+}
+
+var (
+	progressMu       sync.Mutex
+	progressHandlers = make(map[int]func(Progress))
+	nextHandler      int
+)
+
+// HandleProgress calls f with the progress of every download, and returns a
+// function to stop. f is called for one event at a time and must return
+// quickly; the last event of a download is handled before StartDownload
+// goes on.
+func HandleProgress(f func(Progress)) func() {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	id := nextHandler
+	nextHandler++
+	progressHandlers[id] = f
+	return func() {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		delete(progressHandlers, id)
+	}
+}
+
+// SubscribeProgress returns a channel receiving the progress of every
+// download, and a function to stop receiving that closes the channel. A
+// subscriber that does not keep up misses events, the next one tells the
+// whole state again.
+func SubscribeProgress() (<-chan Progress, func()) {
+	ch := make(chan Progress, 16)
+	var once sync.Once
+	stop := HandleProgress(func(p Progress) {
+		select {
+		case ch <- p:
+		default:
+		}
+	})
+	return ch, func() {
+		once.Do(func() {
+			// Once removed the handler is not called any more
+			stop()
+			close(ch)
+		})
+	}
+}
+
+func publishProgress(p Progress) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	for _, handle := range progressHandlers {
+		handle(p)
+	}
+}
+
+// progressTracker counts the verified pieces of one download and publishes
+// its progress
+type progressTracker struct {
+	mu        sync.Mutex
+	state     Progress
+	pieces    []torrent.PieceLocation
+	peerRates func() map[string]float64
+
+	sampled     time.Time // when the rate was last sampled
+	sampleBytes int64     // BytesDone then
+}
+
+func newProgressTracker(torrentFile string, infoHash string, pieces []torrent.PieceLocation, have func(index int) bool) *progressTracker {
+	t := &progressTracker{
+		pieces:  pieces,
+		sampled: time.Now(),
+		state: Progress{
+			Torrent:     torrentFile,
+			InfoHash:    infoHash,
+			PiecesTotal: len(pieces),
+		},
+	}
+	for i, piece := range pieces {
+		t.state.BytesTotal += int64(piece.Length)
+		if have(i) {
+			t.state.PiecesDone++
+			t.state.BytesDone += int64(piece.Length)
+		}
+	}
+	t.sampleBytes = t.state.BytesDone
+	return t
+}
+
+// piece records a verified piece and publishes the progress
+func (t *progressTracker) piece(index int) {
+	t.mu.Lock()
+	t.state.PiecesDone++
+	t.state.BytesDone += int64(t.pieces[index].Length)
+	p := t.snapshot()
+	t.mu.Unlock()
+	publishProgress(p)
+}
+
+// run publishes the progress every progressInterval until stop is closed,
+// then publishes the last event
+func (t *progressTracker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			t.sample()
+			p := t.snapshot()
+			t.mu.Unlock()
+			publishProgress(p)
+		case <-stop:
+			t.mu.Lock()
+			t.state.Done = true
+			t.state.Rate, t.state.ETA, t.state.PeerRates = 0, 0, nil
+			p := t.state
+			t.mu.Unlock()
+			publishProgress(p)
+			return
+		}
+	}
+}
+
+// sample updates the overall rate from the bytes verified since the last
+// sample
+func (t *progressTracker) sample() {
+	now := time.Now()
+	elapsed := now.Sub(t.sampled).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(t.state.BytesDone-t.sampleBytes) / elapsed
+	if t.state.Rate == 0 {
+		t.state.Rate = rate
+	} else {
+		t.state.Rate = 0.7*t.state.Rate + 0.3*rate
+	}
+	t.sampled, t.sampleBytes = now, t.state.BytesDone
+}
+
+// snapshot returns the current progress, t.mu is held
+func (t *progressTracker) snapshot() Progress {
+	p := t.state
+	if t.peerRates != nil {
+		p.PeerRates = t.peerRates()
+	}
+	if p.Rate > 0 {
+		p.ETA = time.Duration(float64(p.BytesTotal-p.BytesDone) / p.Rate * float64(time.Second))
+	}
+	return p
+}
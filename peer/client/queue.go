@@ -0,0 +1,208 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"tcp-app/picker"
+)
+
+// Retrying failed pieces
+const (
+	maxPieceAttempts = 5                // a piece failing this often is given up
+	retryCooldown    = 15 * time.Second // before a peer may retry a piece it failed
+)
+
+// endgamePieces is how few pieces may be left before idle workers also ask
+// their peers for the pieces others are still downloading
+const endgamePieces = 4
+
+var (
+	pickerMu  sync.Mutex
+	newPicker = func() picker.Picker { return picker.NewRarestFirst() }
+)
+
+// SetPicker sets the piece picking strategy of the downloads started from
+// now on, such as picker.Sequential or one of your own. newPicker is called
+// once per download.
+func SetPicker(f func() picker.Picker) {
+	pickerMu.Lock()
+	defer pickerMu.Unlock()
+	newPicker = f
+}
+
+// pickerForDownload returns the picker of a new download
+func pickerForDownload() picker.Picker {
+	pickerMu.Lock()
+	f := newPicker
+	pickerMu.Unlock()
+	return f()
+}
+
+// pieceQueue holds the pieces of a download that nobody is downloading yet,
+// and keeps track of who downloads the others. Workers only take pieces their
+// peer has, and the picker chooses among them. A piece that failed goes back
+// in the queue and is preferably retried by another peer.
+//
+// In the endgame, when only a few pieces are left, a worker without anything
+// else to do takes a piece another worker is already downloading. The first
+// verified copy completes the piece and the other workers cancel theirs.
+type pieceQueue struct {
+	mu          sync.Mutex
+	pieces      []PieceWork
+	picker      picker.Picker
+	avail       *picker.Availability // of every piece among the connected peers
+	attempts    map[int]int
+	failedBy    map[int]map[string]time.Time // when each peer last failed the piece
+	downloading map[int]map[string]bool      // peers each piece in flight is asked from
+	inFlight    map[int]PieceWork
+	completed   map[int]bool
+	news        chan struct{} // closed and replaced when a piece completes
+}
+
+func newPieceQueue(numPieces int, p picker.Picker) *pieceQueue {
+	return &pieceQueue{
+		picker:      p,
+		avail:       picker.NewAvailability(numPieces),
+		attempts:    make(map[int]int),
+		failedBy:    make(map[int]map[string]time.Time),
+		downloading: make(map[int]map[string]bool),
+		inFlight:    make(map[int]PieceWork),
+		completed:   make(map[int]bool),
+		news:        make(chan struct{}),
+	}
+}
+
+// take returns the piece the picker chooses among those for which has
+// returns true and that the peer did not fail recently. In the endgame it
+// falls back to a piece in flight with other peers.
+func (q *pieceQueue) take(peer string, has func(index int) bool) (PieceWork, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var candidates []int
+	position := make(map[int]int)
+	for i, piece := range q.pieces {
+		if failed, ok := q.failedBy[piece.Index][peer]; ok && time.Since(failed) < retryCooldown {
+			continue
+		}
+		if has(piece.Index) {
+			candidates = append(candidates, piece.Index)
+			position[piece.Index] = i
+		}
+	}
+	if len(candidates) > 0 {
+		i := position[q.picker.Pick(candidates, q.avail)]
+		piece := q.pieces[i]
+		q.pieces = append(q.pieces[:i], q.pieces[i+1:]...)
+		q.start(piece, peer)
+		return piece, true
+	}
+
+	if len(q.pieces)+len(q.inFlight) > endgamePieces {
+		return PieceWork{}, false
+	}
+	// Endgame: the piece asked from the fewest peers so far
+	var duplicate PieceWork
+	found := false
+	for index, piece := range q.inFlight {
+		if q.downloading[index][peer] || !has(index) {
+			continue
+		}
+		if !found || len(q.downloading[index]) < len(q.downloading[duplicate.Index]) {
+			duplicate, found = piece, true
+		}
+	}
+	if found {
+		q.start(duplicate, peer)
+	}
+	return duplicate, found
+}
+
+func (q *pieceQueue) start(piece PieceWork, peer string) {
+	if q.downloading[piece.Index] == nil {
+		q.downloading[piece.Index] = make(map[string]bool)
+	}
+	q.downloading[piece.Index][peer] = true
+	q.inFlight[piece.Index] = piece
+}
+
+// release records that the peer no longer downloads the piece. It reports
+// whether others still do.
+func (q *pieceQueue) release(index int, peer string) bool {
+	delete(q.downloading[index], peer)
+	if len(q.downloading[index]) > 0 {
+		return true
+	}
+	delete(q.downloading, index)
+	delete(q.inFlight, index)
+	return false
+}
+
+// complete records a verified piece from the peer. It reports false when
+// another peer completed it first, the copy is then discarded.
+func (q *pieceQueue) complete(index int, peer string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(index, peer)
+	if q.completed[index] {
+		return false
+	}
+	q.completed[index] = true
+	// Copies still in flight elsewhere are not handed out again
+	delete(q.inFlight, index)
+	close(q.news)
+	q.news = make(chan struct{})
+	return true
+}
+
+// isComplete reports whether a verified copy of the piece arrived
+func (q *pieceQueue) isComplete(index int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.completed[index]
+}
+
+// cancel drops the peer's copy of a piece another peer completed
+func (q *pieceQueue) cancel(index int, peer string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(index, peer)
+}
+
+// completions returns a channel that is closed when the next piece completes
+func (q *pieceQueue) completions() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.news
+}
+
+// retry puts back a piece the peer failed, unless it is complete or other
+// peers still download it. It reports false once the piece failed
+// maxPieceAttempts times, it is then given up.
+func (q *pieceQueue) retry(piece PieceWork, peer string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.completed[piece.Index] {
+		return true
+	}
+	q.attempts[piece.Index]++
+	if q.failedBy[piece.Index] == nil {
+		q.failedBy[piece.Index] = make(map[string]time.Time)
+	}
+	q.failedBy[piece.Index][peer] = time.Now()
+	if q.release(piece.Index, peer) {
+		return true
+	}
+	if q.attempts[piece.Index] >= maxPieceAttempts {
+		return false
+	}
+	// At the front, so a sequential picker does not leave it for last
+	q.pieces = append([]PieceWork{piece}, q.pieces...)
+	return true
+}
+
+func (q *pieceQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pieces) == 0
+}
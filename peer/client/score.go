@@ -0,0 +1,127 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer scoring
+const (
+	scoreInterval    = 10 * time.Second // how often the peers of a download are ranked
+	minPeerAge       = 20 * time.Second // a peer is only judged after this long
+	slowPeerFraction = 0.2              // of the best score, below it a peer is slow
+	droppedCooldown  = 5 * time.Minute  // before a dropped peer is dialed again
+)
+
+// PeerScore is what a download measured of one of its peers
+type PeerScore struct {
+	Address      string
+	Rate         float64       // bytes per second
+	Latency      time.Duration // base round trip of a block request
+	Pieces       int           // verified pieces received
+	Failures     int           // pieces that failed, hash failures included
+	HashFailures int
+	Score        float64 // higher is better
+	Connected    bool
+	Slow         bool // scored far below the best peer, gets one piece at a time
+}
+
+// ErrorRate is the share of the pieces from the peer that failed
+func (s PeerScore) ErrorRate() float64 {
+	if s.Pieces+s.Failures == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Pieces+s.Failures)
+}
+
+// peerStats is kept per peer address for the whole download, across
+// reconnects
+type peerStats struct {
+	mu           sync.Mutex
+	depth        *requestDepth // of the current session
+	since        time.Time     // when the current session started
+	pieces       int
+	failures     int
+	hashFailures int
+	slow         bool
+	dropped      time.Time // when the peer was dropped for being slow
+}
+
+func (s *peerStats) connected(depth *requestDepth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.depth, s.since, s.slow = depth, time.Now(), false
+}
+
+func (s *peerStats) verified() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pieces++
+}
+
+func (s *peerStats) failed(hashMismatch bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if hashMismatch {
+		s.hashFailures++
+	}
+}
+
+// isSlow reports whether the peer should only work on one piece at a time
+func (s *peerStats) isSlow() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.slow
+}
+
+// score returns the measurements of the peer. The score is the throughput,
+// reduced by the share of failed pieces and again for every hash failure.
+func (s *peerStats) score(address string) PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := PeerScore{
+		Address:      address,
+		Pieces:       s.pieces,
+		Failures:     s.failures,
+		HashFailures: s.hashFailures,
+		Slow:         s.slow,
+	}
+	if s.depth != nil {
+		ps.Rate, ps.Latency = s.depth.stats()
+	}
+	ps.Score = ps.Rate * (1 - ps.ErrorRate()) / float64(1+s.hashFailures)
+	return ps
+}
+
+var (
+	downloadsMu sync.Mutex
+	downloads   = make(map[string]*peerSet) // running downloads by torrent file
+)
+
+// Peers returns the scores of the peers of a running download, best first
+func Peers(torrentFile string) ([]PeerScore, bool) {
+	downloadsMu.Lock()
+	ps, running := downloads[torrentFile]
+	downloadsMu.Unlock()
+	if !running {
+		return nil, false
+	}
+	return ps.scores(), true
+}
+
+// Downloads returns the torrent files being downloaded
+func Downloads() []string {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	var names []string
+	for name := range downloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
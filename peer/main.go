@@ -2,13 +2,25 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"tcp-app/blocklist"
 	"tcp-app/client"
+	"tcp-app/manager"
+	"tcp-app/picker"
+	"tcp-app/ratelimit"
 	"tcp-app/server"
+	"tcp-app/storage"
+	"tcp-app/swarm"
 	"tcp-app/torrent"
 )
 
@@ -21,22 +33,54 @@ import (
 // 	return slice
 // }
 
+// shutdownTimeout is how long uploads in progress may take to finish on exit
+const shutdownTimeout = 30 * time.Second
+
+// trackerStopTimeout is how long telling the trackers we leave may take
+const trackerStopTimeout = 10 * time.Second
+
 func main() {
+	// Ctrl+C and SIGTERM shut down like the exit command
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	var peerAddress string
 	fmt.Print("Enter your peer address (e.g., 192.168.101.92): ")
 	fmt.Scanln(&peerAddress)
+	// Downloads run in the background, the CLI stays free. The torrents the
+	// server finds complete at startup are listed as seeding.
+	sessions := manager.New(ctx, peerAddress)
+	server.HandleSeeding(sessions.Seed)
+	server.SetDownloadRates(client.DownloadedFrom)
 	go func() {
 		serverAddress := fmt.Sprintf("%s", peerAddress)
-		err := server.StartServer(serverAddress)
+		err := server.StartServer(ctx, serverAddress)
 		if err != nil {
 			log.Fatalf("Failed to start server: %v\n", err)
 		}
 	}()
-	reader := bufio.NewReader(os.Stdin)
+	// Ranges listed in blocklist.txt are refused from the start
+	if n, err := blocklist.Default.Load(defaultBlocklist); err == nil {
+		fmt.Printf("Loaded %d blocked ranges from %s\n", n, defaultBlocklist)
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("Failed to load blocklist: %v\n", err)
+	}
+	commands := readCommands()
 	for {
 		fmt.Print("\n> ") // CLI prompt
-		commandLine, _ := reader.ReadString('\n')
-		commandLine = strings.TrimSpace(commandLine)
+		var commandLine string
+		select {
+		case line, ok := <-commands:
+			if !ok {
+				shutdown(stop, sessions, peerAddress)
+				return
+			}
+			commandLine = strings.TrimSpace(line)
+		case <-ctx.Done():
+			fmt.Println("\nInterrupted")
+			shutdown(stop, sessions, peerAddress)
+			return
+		}
 
 		// Handle commands
 		switch {
@@ -46,9 +90,25 @@ func main() {
 			fmt.Println("Commands:")
 			fmt.Println("  getlistofpeers [one torrent-file] 							- Get list of peers for a specific torrent file")
 			fmt.Println("  getlistoftrackers 											- Get list of trackers connected")
-			fmt.Println("  download [torrent-file] [another-peer-address]  				- Start downloading a file from a torrent file")
+			fmt.Println("  download [torrent-file] [extra-peer-addresses]  				- Download a torrent in the background from the peers its tracker knows, plus any given")
+			fmt.Println("  list                    										- Show the state and progress of every torrent")
+			fmt.Println("  watch [torrent-file]    										- Show the live progress of a download, Enter stops watching")
+			fmt.Println("  peers [torrent-file]    										- Show the scores of the peers of running downloads")
+			fmt.Println("  pause [torrent-file]    										- Pause a download, keeping what was downloaded")
+			fmt.Println("  resume [torrent-file]   										- Queue a paused or failed download again")
+			fmt.Println("  cancel [torrent-file]   										- Stop a download and delete its partial data")
+			fmt.Println("  remove [torrent-file]   										- Take a torrent off the list, stopping its download")
 			fmt.Println("  test [peer-address]           								- Test connection to another peer")
-			fmt.Println("  create [tracker-address] [files]         					- Create a torrent file from multiple source files")
+			fmt.Println("  create [-key swarm-key-id] [tracker-address] [files]		- Create a torrent file from multiple source files")
+			fmt.Println("  swarmkey [new|add|list] [id] [hex-key]						- Manage the keys of restricted swarms")
+			fmt.Println("  recheck [torrent-file]  										- Verify local data against a torrent before seeding it")
+			fmt.Println("  limit [upload|download] [global|torrent-file] [KiB/s]		- Set a bandwidth limit, 0 removes it")
+			fmt.Println("  limits                  										- Show the current bandwidth limits")
+			fmt.Println("  pipeline [depth|auto]   										- Set how many block requests are kept in flight per peer")
+			fmt.Println("  picker [rarest|sequential]								- Set the order in which pieces are downloaded")
+			fmt.Println("  blocklist [load|save] [file]								- Show the blocklist, or load or save a range file")
+			fmt.Println("  block [ip|range]        										- Refuse connections from and to an address or range")
+			fmt.Println("  unblock [ip|range]      										- Remove the blocked ranges overlapping an address or range")
 			fmt.Println("  clear                   										- Clear the terminal")
 			fmt.Println("  exit                    										- Exit the program")
 			continue
@@ -60,7 +120,7 @@ func main() {
 				continue
 			}
 			torrentfilename := args[1]
-			err := client.AnnounceToTracker(peerAddress, torrentfilename)
+			err := client.AnnounceToTracker(ctx, peerAddress, torrentfilename)
 			if err != nil {
 				fmt.Printf("Failed to announce to tracker: %v\n", err)
 			}
@@ -81,7 +141,7 @@ func main() {
 			for _, tf := range tfs {
 				trackerAddress = tf.Announce
 				filename = tf.Name
-				err := client.GetListOfPeersForAFile(trackerAddress, filename)
+				err := client.GetListOfPeersForAFile(ctx, trackerAddress, filename)
 				if err != nil {
 					fmt.Printf("Failed to get list of peers: %v\n", err)
 					continue
@@ -100,28 +160,224 @@ func main() {
 		//-----------------------------------------------------------------------------------------------------
 		case strings.HasPrefix(commandLine, "create"):
 			args := strings.Split(commandLine, " ")
+			// A restricted torrent names the swarm key of its peers
+			swarmKey := ""
+			if len(args) > 2 && args[1] == "-key" {
+				swarmKey = args[2]
+				if _, err := swarm.Key(swarmKey); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				args = append(args[:1], args[3:]...)
+			}
 			if len(args) <= 2 {
-				fmt.Println("Usage: create [tracker-address] [files]")
+				fmt.Println("Usage: create [-key swarm-key-id] [tracker-address] [files]")
 				continue
 			}
 			trackerAddress := args[1]
 			sourceFiles := args[2:]
-			torrentFileName, err := torrent.Create(sourceFiles, trackerAddress)
+			torrentFileName, err := torrent.CreateWithSwarmKey(sourceFiles, trackerAddress, swarmKey)
 			if err != nil {
 				fmt.Printf("Failed to create torrent file: %v\n", err)
 			} else {
 				fmt.Printf("Torrent file created successfully: %s\n", torrentFileName)
+				// Check the data right away so the new torrent can be seeded
+				if err := recheck(torrentFileName); err != nil {
+					fmt.Printf("Recheck failed: %v\n", err)
+				} else {
+					sessions.Seed(torrentFileName)
+				}
 			}
 		//-----------------------------------------------------------------------------------------------------
 		case strings.HasPrefix(commandLine, "download"):
 			args := strings.Split(commandLine, " ")
-			if len(args) < 3 {
-				fmt.Println("Usage: download [torrent-file] [another-peer-address]")
+			if len(args) < 2 {
+				fmt.Println("Usage: download [torrent-file] [extra-peer-addresses]")
 				continue
 			}
 			torrentFile := args[1]
-			anotherPeerAddress := args[2:]
-			client.StartDownload(torrentFile, anotherPeerAddress, peerAddress)
+			extraPeers := args[2:]
+			if err := sessions.Add(torrentFile, extraPeers); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Queued %s, see list or watch %s\n", torrentFile, torrentFile)
+		//-----------------------------------------------------------------------------------------------------
+		case commandLine == "list":
+			printTorrents(sessions.List())
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "peers"):
+			args := strings.Split(commandLine, " ")
+			names := args[1:]
+			if len(names) == 0 {
+				names = client.Downloads()
+			}
+			if len(names) == 0 {
+				fmt.Println("No downloads running")
+				continue
+			}
+			for _, name := range names {
+				scores, running := client.Peers(name)
+				if !running {
+					fmt.Printf("%s is not downloading\n", name)
+					continue
+				}
+				printPeerScores(name, scores)
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "watch"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 2 {
+				fmt.Println("Usage: watch [torrent-file]")
+				continue
+			}
+			if err := watch(ctx, commands, sessions, args[1]); err != nil {
+				fmt.Println(err)
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "pause"), strings.HasPrefix(commandLine, "resume"),
+			strings.HasPrefix(commandLine, "cancel"), strings.HasPrefix(commandLine, "remove"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 2 {
+				fmt.Printf("Usage: %s [torrent-file]\n", args[0])
+				continue
+			}
+			var err error
+			switch args[0] {
+			case "pause":
+				err = sessions.Pause(args[1])
+			case "resume":
+				err = sessions.Resume(args[1])
+			case "cancel":
+				err = sessions.Cancel(args[1])
+			case "remove":
+				err = sessions.Remove(args[1])
+			default:
+				fmt.Println("Unknown command. Type 'menu' for available commands.")
+				continue
+			}
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%s: done\n", args[0])
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "swarmkey"):
+			args := strings.Split(commandLine, " ")
+			if err := manageSwarmKeys(args[1:]); err != nil {
+				fmt.Println(err)
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "recheck"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 2 {
+				fmt.Println("Usage: recheck [torrent-file]")
+				continue
+			}
+			if err := recheck(args[1]); err != nil {
+				fmt.Printf("Recheck failed: %v\n", err)
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case commandLine == "limits":
+			printLimits("Upload", server.UploadLimits)
+			printLimits("Download", client.DownloadLimits)
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "limit"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 4 {
+				fmt.Println("Usage: limit [upload|download] [global|torrent-file] [KiB/s]")
+				continue
+			}
+			if err := setLimit(args[1], args[2], args[3]); err != nil {
+				fmt.Printf("Failed to set limit: %v\n", err)
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "pipeline"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 2 {
+				depth, adaptive := client.Pipeline()
+				mode := "fixed"
+				if adaptive {
+					mode = "adapted per peer"
+				}
+				fmt.Printf("Usage: pipeline [depth|auto] (currently %d, %s)\n", depth, mode)
+				continue
+			}
+			if args[1] == "auto" {
+				client.SetAdaptivePipeline()
+				fmt.Println("Pipeline depth adapts to each peer")
+				continue
+			}
+			depth, err := strconv.Atoi(args[1])
+			if err != nil || depth < 1 {
+				fmt.Println("Depth must be a positive number")
+				continue
+			}
+			client.SetPipelineDepth(depth)
+			fmt.Printf("Pipeline depth set to %d\n", depth)
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "picker"):
+			args := strings.Split(commandLine, " ")
+			if len(args) != 2 {
+				fmt.Println("Usage: picker [rarest|sequential]")
+				continue
+			}
+			if _, ok := picker.New(args[1]); !ok {
+				fmt.Printf("Unknown piece picker: %s\n", args[1])
+				continue
+			}
+			name := args[1]
+			client.SetPicker(func() picker.Picker {
+				p, _ := picker.New(name)
+				return p
+			})
+			fmt.Printf("Piece picker set to %s\n", name)
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "blocklist"):
+			args := strings.Split(commandLine, " ")
+			if len(args) == 1 {
+				printBlocklist()
+				continue
+			}
+			if len(args) != 3 {
+				fmt.Println("Usage: blocklist [load|save] [file]")
+				continue
+			}
+			switch args[1] {
+			case "load":
+				n, err := blocklist.Default.Load(args[2])
+				if err != nil {
+					fmt.Printf("Failed to load blocklist: %v\n", err)
+					continue
+				}
+				fmt.Printf("Loaded %d blocked ranges from %s\n", n, args[2])
+			case "save":
+				if err := blocklist.Default.Save(args[2]); err != nil {
+					fmt.Printf("Failed to save blocklist: %v\n", err)
+					continue
+				}
+				fmt.Printf("Blocklist saved to %s\n", args[2])
+			default:
+				fmt.Println("Usage: blocklist [load|save] [file]")
+			}
+		//-----------------------------------------------------------------------------------------------------
+		case strings.HasPrefix(commandLine, "block"), strings.HasPrefix(commandLine, "unblock"):
+			args := strings.SplitN(commandLine, " ", 2)
+			if len(args) != 2 {
+				fmt.Printf("Usage: %s [ip|range]\n", args[0])
+				continue
+			}
+			r, err := blocklist.ParseRange(args[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if args[0] == "block" {
+				blocklist.Default.Add(r)
+				fmt.Printf("Blocked %s-%s\n", r.Start, r.End)
+			} else {
+				fmt.Printf("Removed %d blocked ranges\n", blocklist.Default.Remove(r))
+			}
 		//-----------------------------------------------------------------------------------------------------
 		case strings.HasPrefix(commandLine, "test"):
 			args := strings.Split(commandLine, " ")
@@ -130,15 +386,14 @@ func main() {
 				continue
 			}
 			peerAddress := args[1]
-			if err := client.TestConnection(peerAddress); err != nil {
+			if err := client.TestConnection(ctx, peerAddress); err != nil {
 				fmt.Printf("Connection failed: %v\n", err)
 			} else {
 				fmt.Printf("Successfully connected to %s\n", peerAddress)
 			}
 		//-----------------------------------------------------------------------------------------------------
 		case commandLine == "exit":
-			fmt.Println("Exiting...")
-			client.DisconnectToTracker(peerAddress)
+			shutdown(stop, sessions, peerAddress)
 			return
 		//-----------------------------------------------------------------------------------------------------
 		case commandLine == "clear":
@@ -149,3 +404,272 @@ func main() {
 		}
 	}
 }
+
+// manageSwarmKeys runs the swarmkey subcommands. A new key is printed so it
+// can be handed to the other members of the swarm.
+func manageSwarmKeys(args []string) error {
+	usage := errors.New("Usage: swarmkey new [id] | swarmkey add [id] [hex-key] | swarmkey list")
+	if len(args) == 0 {
+		return usage
+	}
+	switch {
+	case args[0] == "new" && len(args) == 2:
+		key, err := swarm.NewKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Swarm key %s created, share it with the other peers:\n%x\n", args[1], key)
+	case args[0] == "add" && len(args) == 3:
+		if err := swarm.AddKey(args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Swarm key %s added\n", args[1])
+	case args[0] == "list" && len(args) == 1:
+		ids, err := swarm.IDs()
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			fmt.Println("No swarm keys")
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
+
+// defaultBlocklist is loaded at startup when it exists
+const defaultBlocklist = "blocklist.txt"
+
+func printBlocklist() {
+	ranges := blocklist.Default.Ranges()
+	if len(ranges) == 0 {
+		fmt.Println("No blocked addresses")
+		return
+	}
+	fmt.Printf("%d blocked ranges:\n", len(ranges))
+	for _, r := range ranges {
+		fmt.Println(r)
+	}
+}
+
+// readCommands reads the command lines from stdin in the background, so a
+// signal is noticed while waiting for the next command
+func readCommands() <-chan string {
+	commands := make(chan string)
+	go func() {
+		defer close(commands)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			commands <- line
+		}
+	}()
+	return commands
+}
+
+// shutdown stops accepting peers, lets the uploads in progress finish and
+// tells every tracker we are leaving
+func shutdown(stop context.CancelFunc, sessions *manager.Manager, peerAddress string) {
+	fmt.Println("Exiting...")
+	stop()
+	// Downloads keep what they verified and resume on the next run
+	sessions.Wait()
+	if err := server.Shutdown(shutdownTimeout); err != nil {
+		fmt.Printf("Shutdown: %v\n", err)
+	}
+	// ctx is cancelled by now, the trackers get a moment of their own
+	ctx, cancel := context.WithTimeout(context.Background(), trackerStopTimeout)
+	defer cancel()
+	if err := client.DisconnectToTracker(ctx, peerAddress); err != nil {
+		fmt.Printf("Failed to disconnect from trackers: %v\n", err)
+	}
+}
+
+// recheck hashes the local data of a torrent and reports what can be seeded
+func recheck(torrentFile string) error {
+	tfs, err := torrent.Open("torrent_files/" + torrentFile)
+	if err != nil {
+		return fmt.Errorf("error opening torrent file: %v", err)
+	}
+	bitfield, err := storage.Recheck(tfs, func(done int, total int) {
+		fmt.Printf("\rChecking pieces: %d/%d (%d%%)", done, total, done*100/total)
+	})
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+
+	pieces := torrent.Pieces(tfs)
+	for i, tf := range tfs {
+		good := 0
+		for index, piece := range pieces {
+			if piece.File == i && bitfield.Has(index) {
+				good++
+			}
+		}
+		status := "OK"
+		if good < len(tf.PieceHashes) {
+			status = "INCOMPLETE, only verified pieces will be seeded"
+		}
+		fmt.Printf("  %s: %d/%d pieces %s\n", tf.Name, good, len(tf.PieceHashes), status)
+	}
+	return nil
+}
+
+// setLimit applies a bandwidth limit given in KiB/s from the CLI
+func setLimit(direction string, target string, rate string) error {
+	kib, err := strconv.Atoi(rate)
+	if err != nil || kib < 0 {
+		return fmt.Errorf("invalid rate: %s", rate)
+	}
+	var limits *ratelimit.Set
+	switch direction {
+	case "upload":
+		limits = server.UploadLimits
+	case "download":
+		limits = client.DownloadLimits
+	default:
+		return fmt.Errorf("unknown direction: %s", direction)
+	}
+
+	if target == "global" {
+		limits.Global.SetLimit(kib * 1024)
+		fmt.Printf("Global %s limit set to %s\n", direction, formatLimit(kib*1024))
+		return nil
+	}
+	tfs, err := torrent.Open("torrent_files/" + target)
+	if err != nil {
+		return fmt.Errorf("error opening torrent file: %v", err)
+	}
+	// Sessions are keyed by the info hash of the whole torrent
+	infoHash, err := torrent.InfoHash(tfs)
+	if err != nil {
+		return err
+	}
+	limits.SetTorrentLimit(fmt.Sprintf("%x", infoHash), kib*1024)
+	fmt.Printf("%s limit for %s set to %s\n", direction, target, formatLimit(kib*1024))
+	return nil
+}
+
+func printLimits(direction string, limits *ratelimit.Set) {
+	fmt.Printf("%s: global %s\n", direction, formatLimit(limits.Global.Limit()))
+	for infoHash, limit := range limits.TorrentLimits() {
+		fmt.Printf("  %s: %s\n", infoHash, formatLimit(limit))
+	}
+}
+
+// printTorrents shows the torrents of the session manager
+func printTorrents(torrents []manager.Torrent) {
+	if len(torrents) == 0 {
+		fmt.Println("No torrents, start one with download")
+		return
+	}
+	for _, t := range torrents {
+		switch t.State {
+		case manager.Error:
+			fmt.Printf("%-12s %s: %v\n", t.State, t.Name, t.Err)
+		case manager.Downloading, manager.Paused:
+			p := t.Progress
+			fmt.Printf("%-12s %s: %5.1f%% %d/%d pieces, %s/s from %d peers\n",
+				t.State, t.Name, p.Percent(), p.PiecesDone, p.PiecesTotal, formatBytes(int64(p.Rate)), len(p.PeerRates))
+		default:
+			fmt.Printf("%-12s %s\n", t.State, t.Name)
+		}
+	}
+}
+
+// printPeerScores shows the peers of a download, best first
+func printPeerScores(name string, scores []client.PeerScore) {
+	fmt.Printf("%s:\n", name)
+	if len(scores) == 0 {
+		fmt.Println("  no peers yet")
+		return
+	}
+	fmt.Printf("  %-22s %10s %12s %9s %7s %7s %6s  %s\n", "PEER", "SCORE", "RATE", "LATENCY", "PIECES", "ERRORS", "HASH", "STATE")
+	for _, s := range scores {
+		state := "connected"
+		switch {
+		case !s.Connected:
+			state = "gone"
+		case s.Slow:
+			state = "slow"
+		}
+		fmt.Printf("  %-22s %10.0f %10s/s %9s %7d %6.0f%% %6d  %s\n",
+			s.Address, s.Score, formatBytes(int64(s.Rate)), s.Latency.Round(time.Microsecond), s.Pieces, s.ErrorRate()*100, s.HashFailures, state)
+	}
+}
+
+// watch renders the live progress of a torrent until its download ends, a
+// line is entered or ctx is cancelled
+func watch(ctx context.Context, commands <-chan string, sessions *manager.Manager, name string) error {
+	t, exists := sessions.Get(name)
+	if !exists {
+		return fmt.Errorf("no torrent %s in the list", name)
+	}
+	if t.State != manager.Queued && t.State != manager.Checking && t.State != manager.Downloading {
+		printTorrents([]manager.Torrent{t})
+		return nil
+	}
+	fmt.Println("Press Enter to stop watching")
+	events, unsubscribe := client.SubscribeProgress()
+	defer unsubscribe()
+	for {
+		select {
+		case p := <-events:
+			if p.Torrent != name {
+				continue
+			}
+			showProgress(p)
+			if p.Done {
+				return nil
+			}
+		case <-commands:
+			fmt.Println()
+			return nil
+		case <-ctx.Done():
+			fmt.Println()
+			return nil
+		}
+	}
+}
+
+// showProgress renders download progress as one line, rewritten in place
+// until the download ends
+func showProgress(p client.Progress) {
+	eta := "--"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	fmt.Printf("\r\033[K%s: %5.1f%% %d/%d pieces, %s of %s, %s/s from %d peers, ETA %s",
+		p.Torrent, p.Percent(), p.PiecesDone, p.PiecesTotal,
+		formatBytes(p.BytesDone), formatBytes(p.BytesTotal), formatBytes(int64(p.Rate)), len(p.PeerRates), eta)
+	if p.Done {
+		fmt.Println()
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func formatLimit(bytesPerSec int) string {
+	if bytesPerSec == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KiB/s", bytesPerSec/1024)
+}
@@ -0,0 +1,327 @@
+// Package manager runs the downloads and seeds of this peer in the
+// background, so several torrents are worked on at once while the CLI stays
+// free. Each torrent has a state that can be queried at any time.
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"tcp-app/client"
+	"tcp-app/server"
+	"tcp-app/storage"
+	"tcp-app/torrent"
+)
+
+// State is what the manager is doing with a torrent
+type State string
+
+const (
+	Queued      State = "queued"      // waiting for a download slot
+	Checking    State = "checking"    // verifying the data on disk and finding peers
+	Downloading State = "downloading" // pieces are arriving
+	Paused      State = "paused"      // stopped, resumable
+	Seeding     State = "seeding"     // complete and served to other peers
+	Error       State = "error"       // the download stopped, see Err
+)
+
+// MaxActiveDownloads is how many downloads run at once, the others wait in
+// the queue
+var MaxActiveDownloads = 3
+
+// Torrent is a snapshot of one torrent of the manager
+type Torrent struct {
+	Name     string // torrent file name
+	State    State
+	Err      error           // why the download stopped, in the Error state
+	Progress client.Progress // the latest progress of the download
+}
+
+// Manager keeps the torrents of this peer. Downloads are started in the
+// order they were added, up to MaxActiveDownloads at a time.
+type Manager struct {
+	ctx  context.Context
+	self string // our own address, announced to trackers
+
+	mu       sync.Mutex
+	torrents map[string]*entry
+	order    []string
+	running  sync.WaitGroup
+}
+
+// entry is a torrent of the manager
+type entry struct {
+	name       string
+	extraPeers []string
+	state      State
+	err        error
+	progress   client.Progress
+
+	// Set while a download runs
+	cancel  context.CancelFunc
+	done    chan struct{}
+	pausing bool // the download was stopped to be resumed later
+	removed bool // the torrent left the manager
+}
+
+// New returns a manager whose downloads all stop when ctx is cancelled
+func New(ctx context.Context, self string) *Manager {
+	m := &Manager{
+		ctx:      ctx,
+		self:     self,
+		torrents: make(map[string]*entry),
+	}
+	client.HandleProgress(m.update)
+	return m
+}
+
+// Add queues the download of a torrent. A paused or failed download is
+// queued again.
+func (m *Manager) Add(name string, extraPeers []string) error {
+	if _, err := torrent.Open("torrent_files/" + name); err != nil {
+		return fmt.Errorf("error opening torrent file: %v", err)
+	}
+	m.mu.Lock()
+	e, exists := m.torrents[name]
+	if exists && e.state != Paused && e.state != Error {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is already %s", name, e.state)
+	}
+	if !exists {
+		e = &entry{name: name}
+		m.torrents[name] = e
+		m.order = append(m.order, name)
+	}
+	e.extraPeers = extraPeers
+	e.state, e.err = Queued, nil
+	m.mu.Unlock()
+	server.Seed(name)
+	m.schedule()
+	return nil
+}
+
+// Seed lists a torrent whose data is complete as seeding, and serves it
+// again if it was removed
+func (m *Manager) Seed(name string) {
+	m.mu.Lock()
+	if _, exists := m.torrents[name]; !exists {
+		m.torrents[name] = &entry{name: name, state: Seeding}
+		m.order = append(m.order, name)
+	}
+	m.mu.Unlock()
+	server.Seed(name)
+}
+
+// List returns every torrent of the manager, in the order they were added
+func (m *Manager) List() []Torrent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Torrent, 0, len(m.order))
+	for _, name := range m.order {
+		list = append(list, m.torrents[name].snapshot())
+	}
+	return list
+}
+
+// Get returns one torrent of the manager
+func (m *Manager) Get(name string) (Torrent, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, exists := m.torrents[name]
+	if !exists {
+		return Torrent{}, false
+	}
+	return e.snapshot(), true
+}
+
+// Pause stops a download, what was verified stays on disk for Resume
+func (m *Manager) Pause(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	switch e.state {
+	case Queued:
+		e.state = Paused
+	case Checking, Downloading:
+		e.pausing = true
+		e.state = Paused
+		e.cancel()
+	default:
+		return fmt.Errorf("%s is %s, only downloads can be paused", name, e.state)
+	}
+	return nil
+}
+
+// Resume queues a paused or failed download again
+func (m *Manager) Resume(name string) error {
+	m.mu.Lock()
+	e, err := m.lookup(name)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if e.state != Paused && e.state != Error {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is %s, only paused or failed downloads can be resumed", name, e.state)
+	}
+	if e.done != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is still stopping", name)
+	}
+	e.state, e.err = Queued, nil
+	m.mu.Unlock()
+	m.schedule()
+	return nil
+}
+
+// Cancel stops a download for good: it leaves the manager and its partial
+// data is deleted
+func (m *Manager) Cancel(name string) error {
+	tfs, err := torrent.Open("torrent_files/" + name)
+	if err != nil {
+		return fmt.Errorf("error opening torrent file: %v", err)
+	}
+	infoHash, err := torrent.InfoHash(tfs)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	e, err := m.lookup(name)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if e.state == Seeding {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is complete, use remove", name)
+	}
+	done := m.drop(e)
+	m.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	return storage.Discard(fmt.Sprintf("%x", infoHash), tfs)
+}
+
+// Remove takes a torrent off the manager. A download is stopped and what it
+// verified is kept, so downloading the torrent again resumes it. Either way
+// the torrent is no longer served to peers, its data stays on disk until it
+// is downloaded again or the peer restarts.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	e, err := m.lookup(name)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.drop(e)
+	m.mu.Unlock()
+	server.StopSeeding(name)
+	return nil
+}
+
+// Wait blocks until the running downloads have stopped, once the context of
+// the manager is cancelled
+func (m *Manager) Wait() {
+	m.running.Wait()
+}
+
+func (m *Manager) lookup(name string) (*entry, error) {
+	e, exists := m.torrents[name]
+	if !exists {
+		return nil, fmt.Errorf("no torrent %s in the list", name)
+	}
+	return e, nil
+}
+
+// drop removes an entry and stops its download. It returns a channel closed
+// once the download stopped, or nil if none ran. m.mu is held.
+func (m *Manager) drop(e *entry) chan struct{} {
+	delete(m.torrents, e.name)
+	for i, name := range m.order {
+		if name == e.name {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	e.removed = true
+	if e.cancel != nil {
+		e.cancel()
+	}
+	return e.done
+}
+
+// schedule starts queued downloads while slots are free
+func (m *Manager) schedule() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return
+	}
+	active := 0
+	for _, e := range m.torrents {
+		if e.done != nil {
+			active++
+		}
+	}
+	for _, name := range m.order {
+		if active >= MaxActiveDownloads {
+			return
+		}
+		if e := m.torrents[name]; e.state == Queued {
+			m.start(e)
+			active++
+		}
+	}
+}
+
+// start runs the download of an entry, m.mu is held
+func (m *Manager) start(e *entry) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	e.state = Checking
+	e.cancel, e.done, e.pausing = cancel, make(chan struct{}), false
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		err := client.StartDownload(ctx, e.name, e.extraPeers, m.self)
+		cancel()
+
+		m.mu.Lock()
+		switch {
+		case e.removed:
+		case e.pausing || m.ctx.Err() != nil:
+			e.state = Paused
+		case err == nil:
+			e.state = Seeding
+		default:
+			e.state, e.err = Error, err
+			fmt.Printf("Download of %s stopped: %v\n", e.name, err)
+		}
+		close(e.done)
+		e.cancel, e.done = nil, nil
+		m.mu.Unlock()
+		m.schedule()
+	}()
+}
+
+// update records the progress of a running download
+func (m *Manager) update(p client.Progress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, exists := m.torrents[p.Torrent]
+	if !exists || e.done == nil {
+		return
+	}
+	e.progress = p
+	if e.state == Checking {
+		e.state = Downloading
+	}
+}
+
+func (e *entry) snapshot() Torrent {
+	return Torrent{Name: e.name, State: e.state, Err: e.err, Progress: e.progress}
+}
@@ -0,0 +1,127 @@
+// Package picker decides which piece a download asks a peer for next.
+// Strategies implement Picker; the availability of each piece in the swarm
+// is tracked for them from the bitfields and HAVE announcements of peers.
+package picker
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Picker chooses the next piece to download from a peer. Calls are made one
+// at a time.
+type Picker interface {
+	// Pick returns one of candidates, the wanted pieces the peer has, in
+	// queue order. It is never called without candidates.
+	Pick(candidates []int, avail *Availability) int
+}
+
+// Availability counts how many connected peers hold each piece
+type Availability struct {
+	mu     sync.Mutex
+	counts []int
+}
+
+func NewAvailability(numPieces int) *Availability {
+	return &Availability{counts: make([]int, numPieces)}
+}
+
+// AddPeer counts the pieces of a peer that connected
+func (a *Availability) AddPeer(has func(index int) bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.counts {
+		if has(i) {
+			a.counts[i]++
+		}
+	}
+}
+
+// RemovePeer stops counting the pieces of a peer that left
+func (a *Availability) RemovePeer(has func(index int) bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.counts {
+		if has(i) && a.counts[i] > 0 {
+			a.counts[i]--
+		}
+	}
+}
+
+// Have counts a piece a connected peer announced
+func (a *Availability) Have(index int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index >= 0 && index < len(a.counts) {
+		a.counts[index]++
+	}
+}
+
+// Count returns how many connected peers hold a piece
+func (a *Availability) Count(index int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index < 0 || index >= len(a.counts) {
+		return 0
+	}
+	return a.counts[index]
+}
+
+// Sequential downloads pieces in index order, for files read while they
+// download
+type Sequential struct{}
+
+func (Sequential) Pick(candidates []int, avail *Availability) int {
+	first := candidates[0]
+	for _, index := range candidates[1:] {
+		if index < first {
+			first = index
+		}
+	}
+	return first
+}
+
+// StarterPieces is how many pieces RarestFirst picks at random, so a new
+// peer soon has something to share that others lack
+const StarterPieces = 4
+
+// RarestFirst downloads the pieces fewest peers hold first, so they spread
+// before their holders leave. Ties are broken at random.
+type RarestFirst struct {
+	picked int
+}
+
+func NewRarestFirst() *RarestFirst {
+	return &RarestFirst{}
+}
+
+func (r *RarestFirst) Pick(candidates []int, avail *Availability) int {
+	r.picked++
+	if r.picked <= StarterPieces {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	var rarest []int
+	fewest := 0
+	for _, index := range candidates {
+		count := avail.Count(index)
+		switch {
+		case len(rarest) == 0 || count < fewest:
+			rarest = append(rarest[:0], index)
+			fewest = count
+		case count == fewest:
+			rarest = append(rarest, index)
+		}
+	}
+	return rarest[rand.Intn(len(rarest))]
+}
+
+// New returns the strategy with the given name: rarest or sequential
+func New(name string) (Picker, bool) {
+	switch name {
+	case "rarest":
+		return NewRarestFirst(), true
+	case "sequential":
+		return Sequential{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDeadline is returned when waiting for tokens would run past the deadline
+var ErrDeadline = errors.New("rate limit wait exceeds deadline")
+
+// ChunkSize is how much data the throttled readers and writers move at once
+const ChunkSize = 16 * 1024
+
+// Limiter is a token bucket. Tokens are bytes, refilled at rate bytes per
+// second up to one second worth of burst. A rate of 0 means unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing bytesPerSec bytes per second (0 = unlimited).
+func New(bytesPerSec int) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(bytesPerSec)
+	return l
+}
+
+// SetLimit changes the rate. It takes effect for the next wait.
+func (l *Limiter) SetLimit(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	l.rate = float64(bytesPerSec)
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+// Limit returns the current rate in bytes per second (0 = unlimited).
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+func (l *Limiter) burst() float64 {
+	if l.rate < ChunkSize {
+		return ChunkSize
+	}
+	return l.rate
+}
+
+// reserve takes n tokens, possibly going into debt, and returns how long the
+// caller has to wait before using them. Nothing is taken if the wait would
+// pass the deadline.
+func (l *Limiter) reserve(n int, deadline time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	l.last = now
+
+	var wait time.Duration
+	if missing := float64(n) - l.tokens; missing > 0 {
+		wait = time.Duration(missing / l.rate * float64(time.Second))
+	}
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		return 0, ErrDeadline
+	}
+	l.tokens -= float64(n)
+	return wait, nil
+}
+
+// refund gives back n tokens that were reserved but not used
+func (l *Limiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return
+	}
+	l.tokens += float64(n)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// WaitN blocks until n bytes may be transferred. A zero deadline waits as
+// long as needed.
+func (l *Limiter) WaitN(n int, deadline time.Time) error {
+	wait, err := l.reserve(n, deadline)
+	if err != nil {
+		return err
+	}
+	time.Sleep(wait)
+	return nil
+}
+
+// Wait blocks until every non-nil limiter allows n bytes.
+func Wait(n int, deadline time.Time, limiters ...*Limiter) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if err := l.WaitN(n, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer throttles writes to W through the given limiters. Deadline should
+// match the write deadline set on the underlying connection.
+type Writer struct {
+	W        io.Writer
+	Limiters []*Limiter
+	Deadline time.Time
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := len(p) - written
+		if chunk > ChunkSize {
+			chunk = ChunkSize
+		}
+		if err := Wait(chunk, w.Deadline, w.Limiters...); err != nil {
+			return written, err
+		}
+		n, err := w.W.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reader throttles reads from R through the given limiters. Deadline should
+// match the read deadline set on the underlying connection.
+type Reader struct {
+	R        io.Reader
+	Limiters []*Limiter
+	Deadline time.Time
+}
+
+// Read waits for tokens for all of p, then gives back those of the bytes the
+// read did not return. A network read often returns much less than asked.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) > ChunkSize {
+		p = p[:ChunkSize]
+	}
+	if err := Wait(len(p), r.Deadline, r.Limiters...); err != nil {
+		return 0, err
+	}
+	n, err := r.R.Read(p)
+	if unused := len(p) - n; unused > 0 {
+		for _, l := range r.Limiters {
+			if l != nil {
+				l.refund(unused)
+			}
+		}
+	}
+	return n, err
+}
+
+// Set holds a global limiter and optional per-torrent limiters keyed by the
+// hex info hash used in the handshake.
+type Set struct {
+	Global *Limiter
+
+	mu         sync.Mutex
+	perTorrent map[string]*Limiter
+}
+
+// NewSet creates a set with no limits.
+func NewSet() *Set {
+	return &Set{
+		Global:     New(0),
+		perTorrent: make(map[string]*Limiter),
+	}
+}
+
+// SetTorrentLimit sets the rate for one torrent. A rate of 0 removes it.
+func (s *Set) SetTorrentLimit(infoHash string, bytesPerSec int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytesPerSec <= 0 {
+		delete(s.perTorrent, infoHash)
+		return
+	}
+	if l, exists := s.perTorrent[infoHash]; exists {
+		l.SetLimit(bytesPerSec)
+		return
+	}
+	s.perTorrent[infoHash] = New(bytesPerSec)
+}
+
+// TorrentLimits returns the per-torrent rates in bytes per second.
+func (s *Set) TorrentLimits() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limits := make(map[string]int, len(s.perTorrent))
+	for infoHash, l := range s.perTorrent {
+		limits[infoHash] = l.Limit()
+	}
+	return limits
+}
+
+// Limiters returns the limiters that apply to a transfer for infoHash.
+func (s *Set) Limiters(infoHash string) []*Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []*Limiter{s.Global, s.perTorrent[infoHash]}
+}
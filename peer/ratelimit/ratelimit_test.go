@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+const testRate = 256 * 1024
+
+// shortReader returns at most one TCP segment per read, like a connection
+type shortReader struct {
+	left int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), 1460, r.left)
+	r.left -= n
+	return n, nil
+}
+
+// checkRate fails unless moving bytes took about as long as the limit
+// allows, after the burst of one second worth that the limiter starts with
+func checkRate(t *testing.T, bytes int, elapsed time.Duration) {
+	t.Helper()
+	want := time.Duration(float64(bytes-testRate) / testRate * float64(time.Second))
+	if elapsed < want*3/4 || elapsed > want*3/2 {
+		t.Fatalf("moved %d bytes in %v, want about %v at %d B/s", bytes, elapsed, want, testRate)
+	}
+}
+
+func TestReaderThroughput(t *testing.T) {
+	const total = testRate + testRate/2
+	r := &Reader{R: &shortReader{left: total}, Limiters: []*Limiter{New(testRate)}}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != total {
+		t.Fatalf("read %d bytes, err %v", n, err)
+	}
+	checkRate(t, total, time.Since(start))
+}
+
+func TestWriterThroughput(t *testing.T) {
+	const total = testRate + testRate/2
+	w := &Writer{W: io.Discard, Limiters: []*Limiter{New(testRate)}}
+	start := time.Now()
+	if n, err := w.Write(make([]byte, total)); err != nil || n != total {
+		t.Fatalf("wrote %d bytes, err %v", n, err)
+	}
+	checkRate(t, total, time.Since(start))
+}
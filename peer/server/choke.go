@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Choking parameters, loosely following the reference BitTorrent client.
+const (
+	uploadSlots             = 4
+	rechokeInterval         = 10 * time.Second
+	optimisticUnchokeRounds = 3                   // the optimistic slot rotates every 30s
+	newcomerWindow          = 3 * rechokeInterval // peers younger than this are favored optimistically
+	chokePeerIdleTimeout    = 3 * rechokeInterval // peers that stop asking lose their slot
+)
+
+// chokePeer is the choker's view of one peer session.
+type chokePeer struct {
+	host           string // tit-for-tat is judged per host, our client dials from another port
+	firstSeen      time.Time
+	lastSeen       time.Time
+	uploaded       int64 // piece bytes we sent to the peer
+	lastUploaded   int64
+	lastDownloaded int64
+	uploadRate     float64 // bytes/s we sent during the last round
+	downloadRate   float64 // bytes/s the peer sent us during the last round
+	unchoked       bool
+}
+
+// Choker decides which peers may download from us. A fixed number of upload
+// slots is handed out every rechokeInterval: the regular slots go to the peers
+// that upload to us fastest (tit-for-tat), then to the peers we upload to
+// fastest, and one slot is kept for an optimistic unchoke so newcomers get a
+// chance to prove themselves.
+type Choker struct {
+	mu         sync.Mutex
+	slots      int
+	peers      map[string]*chokePeer
+	optimistic string
+	round      int
+	// downloadedFrom reports how many bytes we received from a peer host
+	downloadedFrom func(host string) int64
+}
+
+// NewChoker creates a choker with the given number of upload slots.
+func NewChoker(slots int) *Choker {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Choker{
+		slots:          slots,
+		peers:          make(map[string]*chokePeer),
+		downloadedFrom: func(string) int64 { return 0 },
+	}
+}
+
+// SetDownloadRates tells the choker how many bytes we received from a peer
+// host, for tit-for-tat. Until it is set every peer counts as uploading
+// nothing to us.
+func SetDownloadRates(downloadedFrom func(host string) int64) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	choker.downloadedFrom = downloadedFrom
+}
+
+// Run recomputes the unchoked set every interval until ctx is cancelled.
+func (c *Choker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.rechoke(interval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Allow registers interest from the peer and reports whether it is currently
+// unchoked. A newcomer is unchoked straight away while there is a free slot.
+func (c *Choker) Allow(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	p, exists := c.peers[id]
+	if !exists {
+		host, _, err := net.SplitHostPort(id)
+		if err != nil {
+			host = id
+		}
+		p = &chokePeer{
+			host:           host,
+			firstSeen:      now,
+			lastDownloaded: c.downloadedFrom(host),
+		}
+		c.peers[id] = p
+		if c.unchokedCount() < c.slots {
+			p.unchoked = true
+		}
+	}
+	p.lastSeen = now
+	return p.unchoked
+}
+
+// Uploaded records n piece bytes sent to the peer.
+func (c *Choker) Uploaded(id string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, exists := c.peers[id]; exists {
+		p.uploaded += int64(n)
+	}
+}
+
+// Remove forgets a peer whose session has ended, freeing its slot.
+func (c *Choker) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, id)
+	if c.optimistic == id {
+		c.optimistic = ""
+	}
+}
+
+func (c *Choker) unchokedCount() int {
+	count := 0
+	for _, p := range c.peers {
+		if p.unchoked {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Choker) rechoke(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	seconds := interval.Seconds()
+	for id, p := range c.peers {
+		if now.Sub(p.lastSeen) > chokePeerIdleTimeout {
+			delete(c.peers, id)
+			continue
+		}
+		downloaded := c.downloadedFrom(p.host)
+		p.uploadRate = float64(p.uploaded-p.lastUploaded) / seconds
+		p.downloadRate = float64(downloaded-p.lastDownloaded) / seconds
+		p.lastUploaded = p.uploaded
+		p.lastDownloaded = downloaded
+	}
+	if len(c.peers) == 0 {
+		c.optimistic = ""
+		return
+	}
+
+	c.round++
+	if _, exists := c.peers[c.optimistic]; !exists || c.round%optimisticUnchokeRounds == 0 {
+		c.optimistic = c.pickOptimistic(now)
+	}
+
+	// Rank everybody else for the regular slots
+	var ranked []string
+	for id := range c.peers {
+		if id != c.optimistic {
+			ranked = append(ranked, id)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := c.peers[ranked[i]], c.peers[ranked[j]]
+		if a.downloadRate != b.downloadRate {
+			return a.downloadRate > b.downloadRate
+		}
+		if a.uploadRate != b.uploadRate {
+			return a.uploadRate > b.uploadRate
+		}
+		return a.firstSeen.Before(b.firstSeen)
+	})
+
+	regular := c.slots
+	if c.optimistic != "" {
+		regular--
+	}
+	for _, p := range c.peers {
+		p.unchoked = false
+	}
+	for i, id := range ranked {
+		if i >= regular {
+			break
+		}
+		c.peers[id].unchoked = true
+	}
+	if c.optimistic != "" {
+		c.peers[c.optimistic].unchoked = true
+	}
+}
+
+// pickOptimistic chooses a random choked peer, giving newcomers three times
+// the weight of peers that have been around for a while.
+func (c *Choker) pickOptimistic(now time.Time) string {
+	var candidates []string
+	for id, p := range c.peers {
+		if p.unchoked && id != c.optimistic {
+			continue
+		}
+		weight := 1
+		if now.Sub(p.firstSeen) < newcomerWindow {
+			weight = 3
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/storage"
+	"tcp-app/torrent"
+)
+
+// indexRefreshInterval is how often torrent_files/ is checked for changes
+const indexRefreshInterval = 5 * time.Second
+
+// torrentEntry is what the index knows about one torrent
+type torrentEntry struct {
+	InfoHash    string // hex, of the whole torrent (see torrent.InfoHash)
+	TorrentName string // file name in torrent_files/
+	Files       []torrent.TorrentFile
+}
+
+// torrentIndex maps every info hash found in torrent_files/, of a whole
+// torrent or of one of its files, to the torrent. It is rebuilt whenever the
+// directory changes.
+type torrentIndex struct {
+	mu        sync.RWMutex
+	entries   map[string]*torrentEntry
+	signature string
+	stopped   map[string]bool // torrent files left out of the index, see StopSeeding
+}
+
+// index routes handshakes to the torrents we can serve
+var index = &torrentIndex{
+	entries: make(map[string]*torrentEntry),
+	stopped: make(map[string]bool),
+}
+
+var (
+	seedingMu      sync.Mutex
+	seedingHandler func(torrentName string)
+)
+
+// HandleSeeding calls f with the name of every indexed torrent whose data is
+// complete, as the index finds them. Set it before StartServer to hear of
+// the torrents seeded from the start.
+func HandleSeeding(f func(torrentName string)) {
+	seedingMu.Lock()
+	defer seedingMu.Unlock()
+	seedingHandler = f
+}
+
+func seeding(torrentName string) {
+	seedingMu.Lock()
+	f := seedingHandler
+	seedingMu.Unlock()
+	if f != nil {
+		f(torrentName)
+	}
+}
+
+// StopSeeding leaves a torrent out of the index and closes the sessions
+// serving it. Its files stay where they are until Seed serves it again, or
+// the next start.
+func StopSeeding(torrentName string) {
+	var infoHash string
+	if tfs, err := ParseTorrentFile(torrentName); err == nil {
+		if hash, err := torrent.InfoHash(tfs); err == nil {
+			infoHash = fmt.Sprintf("%x", hash)
+		}
+	}
+	index.stop(torrentName, true)
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for s := range sessions {
+		if infoHash != "" && s.infoHash == infoHash {
+			s.conn.Close()
+		}
+	}
+}
+
+// Seed serves a torrent StopSeeding left out again
+func Seed(torrentName string) {
+	index.stop(torrentName, false)
+}
+
+// stop leaves a torrent out of the index or takes it back, and rebuilds the
+// index
+func (ix *torrentIndex) stop(torrentName string, stopped bool) {
+	ix.mu.Lock()
+	if ix.stopped[torrentName] == stopped {
+		ix.mu.Unlock()
+		return
+	}
+	if stopped {
+		ix.stopped[torrentName] = true
+	} else {
+		delete(ix.stopped, torrentName)
+	}
+	ix.signature = ""
+	ix.mu.Unlock()
+	if err := ix.refresh(); err != nil {
+		fmt.Printf("Error refreshing torrent index: %v\n", err)
+	}
+}
+
+// lookup returns the entry for a hex info hash, or nil
+func (ix *torrentIndex) lookup(infoHash string) *torrentEntry {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.entries[strings.ToLower(infoHash)]
+}
+
+// refresh rebuilds the index if torrent_files/ changed since the last call
+func (ix *torrentIndex) refresh() error {
+	names, err := ListTorrentFiles()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	// Names, sizes and modification times tell us whether anything changed
+	var signature strings.Builder
+	for _, name := range names {
+		info, err := os.Stat("torrent_files/" + name)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+	}
+	ix.mu.RLock()
+	unchanged := signature.String() == ix.signature
+	ix.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var torrents []*torrentEntry
+	for _, name := range names {
+		ix.mu.RLock()
+		stopped := ix.stopped[name]
+		ix.mu.RUnlock()
+		if stopped {
+			continue
+		}
+		tfs, err := ParseTorrentFile(name)
+		if err != nil {
+			fmt.Printf("Skipping torrent %s: %v\n", name, err)
+			continue
+		}
+		infoHash, err := torrent.InfoHash(tfs)
+		if err != nil {
+			fmt.Printf("Skipping torrent %s: %v\n", name, err)
+			continue
+		}
+		torrents = append(torrents, &torrentEntry{
+			InfoHash:    fmt.Sprintf("%x", infoHash),
+			TorrentName: name,
+			Files:       tfs,
+		})
+	}
+
+	// A file may be part of several torrents, the hash of a whole torrent
+	// always wins over the hash of a file
+	entries := make(map[string]*torrentEntry)
+	for _, entry := range torrents {
+		for _, tf := range entry.Files {
+			entries[fmt.Sprintf("%x", tf.InfoHash)] = entry
+		}
+	}
+	for _, entry := range torrents {
+		entries[entry.InfoHash] = entry
+	}
+
+	ix.mu.Lock()
+	ix.entries = entries
+	ix.signature = signature.String()
+	ix.mu.Unlock()
+	fmt.Printf("Torrent index: %d info hashes from %d torrent files\n", len(entries), len(torrents))
+	go verifyNewTorrents(torrents)
+	return nil
+}
+
+// watch refreshes the index every interval until ctx is cancelled.
+func (ix *torrentIndex) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ix.refresh(); err != nil {
+				fmt.Printf("Error refreshing torrent index: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// verifyNewTorrents checks, one after the other, the indexed torrents that
+// were never checked, so torrents present at startup or added later are
+// seeded without a manual recheck. The complete ones are passed to the
+// seeding handler.
+func verifyNewTorrents(entries []*torrentEntry) {
+	for _, entry := range entries {
+		numPieces := len(torrent.Pieces(entry.Files))
+		bitfield, done := storage.Verified(entry.InfoHash)
+		if !done {
+			var err error
+			bitfield, err = storage.Recheck(entry.Files, nil)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("Verified %s: %d/%d pieces\n", entry.TorrentName, bitfield.Count(), numPieces)
+		}
+		index.mu.RLock()
+		stopped := index.stopped[entry.TorrentName]
+		index.mu.RUnlock()
+		if bitfield.Count() == numPieces && !stopped {
+			seeding(entry.TorrentName)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection limits, so idle or stalled peers cannot hold goroutines and file
+// descriptors forever
+const (
+	maxConnections      = 200
+	maxConnectionsPerIP = 8
+	handshakeTimeout    = 10 * time.Second // from accept to a bound session
+	idleTimeout         = 2 * time.Minute  // without a message from the peer or a block to it
+	keepaliveInterval   = 30 * time.Second // KEEPALIVE after this long without sending
+	replyTimeout        = 30 * time.Second // a peer must take a reply line within this
+)
+
+// connLimiter counts the open connections, in total and per remote IP
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var conns = &connLimiter{perIP: make(map[string]int)}
+
+// acquire takes a connection slot for the remote address, or reports which
+// limit was hit
+func (l *connLimiter) acquire(addr net.Addr) error {
+	host := remoteHost(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.total >= maxConnections {
+		return errors.New("Too many connections")
+	}
+	if l.perIP[host] >= maxConnectionsPerIP {
+		return errors.New("Too many connections from your address")
+	}
+	l.total++
+	l.perIP[host]++
+	return nil
+}
+
+func (l *connLimiter) release(addr net.Addr) {
+	host := remoteHost(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[host]--; l.perIP[host] <= 0 {
+		delete(l.perIP, host)
+	}
+}
+
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// refuse tells a peer why it is disconnected, without waiting on it
+func refuse(conn net.Conn, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ERROR: " + reason + "\n"))
+	conn.Close()
+}
@@ -2,125 +2,405 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/blocklist"
+	"tcp-app/ratelimit"
+	"tcp-app/storage"
+	"tcp-app/swarm"
 	"tcp-app/torrent"
 )
 
-// StartServer initializes the server to handle peer requests.
-func StartServer(serverAddress string) error {
+// UploadLimits throttles the piece data we serve, globally and per torrent
+var UploadLimits = ratelimit.NewSet()
+
+// StartServer initializes the server to handle peer requests. It stops
+// accepting connections when ctx is cancelled; Shutdown then drains the
+// connections still open.
+func StartServer(ctx context.Context, serverAddress string) error {
 	listener, err := net.Listen("tcp", serverAddress)
 	if err != nil {
 		return fmt.Errorf("error starting TCP server: %v", err)
 	}
 	defer listener.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	if err := index.refresh(); err != nil {
+		fmt.Printf("Error building torrent index: %v\n", err)
+	}
+	go index.watch(ctx, indexRefreshInterval)
+	go choker.Run(ctx, rechokeInterval)
 
 	fmt.Printf("Server listening on %s...\n", serverAddress)
 	for {
 		conn, err := listener.Accept() // Chấp nhận kết nối từ client
 		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Println("Server stopped accepting connections")
+				return nil
+			}
 			fmt.Printf("Error accepting connection: %v\n", err)
 			continue
 		}
+		if r, blocked := blocklist.Default.Blocked(conn.RemoteAddr().String()); blocked {
+			fmt.Printf("Refused blocked peer %s (%s)\n", conn.RemoteAddr(), r)
+			conn.Close()
+			continue
+		}
+		if err := conns.acquire(conn.RemoteAddr()); err != nil {
+			fmt.Printf("Refused peer %s: %v\n", conn.RemoteAddr(), err)
+			refuse(conn, err.Error())
+			continue
+		}
 		// Handle each connection in a new goroutine
-		go handleConnection(conn)
+		go func() {
+			defer conns.release(conn.RemoteAddr())
+			handleConnection(conn)
+		}()
 	}
 }
 
-type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+// Live sessions, so Shutdown can drain them
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[*session]struct{})
+	sessionsWG sync.WaitGroup
+	draining   bool
+)
+
+// Shutdown stops reading new requests on every connection and waits for
+// the blocks already requested to be sent. Connections still busy after
+// timeout are closed.
+func Shutdown(timeout time.Duration) error {
+	sessionsMu.Lock()
+	draining = true
+	for s := range sessions {
+		// Unblocks the reader, the session then serves what is queued
+		s.conn.SetReadDeadline(time.Now())
+	}
+	sessionsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sessionsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	sessionsMu.Lock()
+	busy := len(sessions)
+	for s := range sessions {
+		s.conn.Close()
+	}
+	sessionsMu.Unlock()
+	<-done
+	return fmt.Errorf("%d connections did not finish within %v", busy, timeout)
 }
 
-// FileWorker handles the file pieces for a specific torrent
+func isDraining() bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return draining
+}
+
+// FileWorker serves the pieces of a torrent from its data files in files/.
+// Pieces are numbered across the files of the torrent (see torrent.Pieces)
+// and read from disk when requested. Only pieces that passed verification
+// are served, and each is hashed again the first time the session serves it.
+// A FileWorker belongs to one session and is not safe for concurrent use.
 type FileWorker struct {
-	filePath    string
-	pieces      [][]byte
-	numPieces   int
-	pieceHashes [][20]byte
+	infoHash string
+	pieces   []torrent.PieceLocation
+	files    []*os.File // nil for files we do not have
+	checked  storage.Bitfield
 }
 
-// NewFileWorker creates and initializes a new FileWorker
-func NewFileWorker(filePath string) (*FileWorker, error) {
-	t := &TorrentFile{
-		PieceLength: 256 * 1024, // 256KB pieces
+// NewFileWorker opens the data files of a torrent. Files that are missing or
+// have the wrong size are left out and their pieces are not served.
+func NewFileWorker(infoHash string, tfs []torrent.TorrentFile) (*FileWorker, error) {
+	w := &FileWorker{
+		infoHash: infoHash,
+		pieces:   torrent.Pieces(tfs),
+		files:    make([]*os.File, len(tfs)),
 	}
-	// Get pieces using the StreamFilePieces function
-	pieces, err := torrent.StreamFilePieces(filePath, t.PieceLength)
-	if err != nil {
-		return nil, fmt.Errorf("error streaming file pieces: %v", err)
+	w.checked = storage.NewBitfield(len(w.pieces))
+	available := 0
+	for i, tf := range tfs {
+		file, err := os.Open("files/" + tf.Name)
+		if err != nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil || info.Size() != int64(tf.Length) {
+			file.Close()
+			continue
+		}
+		w.files[i] = file
+		available++
+	}
+	if available == 0 {
+		return nil, fmt.Errorf("no data files found for %s", tfs[0].Name)
 	}
+	return w, nil
+}
+
+// Close closes the data files
+func (w *FileWorker) Close() error {
+	for _, file := range w.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// NumPieces returns the number of pieces in the torrent
+func (w *FileWorker) NumPieces() int {
+	return len(w.pieces)
+}
+
+// Bitfield reports the verified pieces of every file we have
+func (w *FileWorker) Bitfield() storage.Bitfield {
+	verified, _ := storage.Verified(w.infoHash)
+	bf := storage.NewBitfield(len(w.pieces))
+	for i, piece := range w.pieces {
+		if w.files[piece.File] != nil && verified.Has(i) {
+			bf.Set(i)
+		}
+	}
+	return bf
+}
+
+// Block reads length bytes at offset begin of a piece from its data file
+func (w *FileWorker) Block(index int, begin int, length int) ([]byte, bool) {
+	if !w.servable(index) {
+		return nil, false
+	}
+	piece := w.pieces[index]
+	if begin > piece.Length || length > piece.Length-begin {
+		return nil, false
+	}
+	data := make([]byte, length)
+	if _, err := w.files[piece.File].ReadAt(data, piece.Offset+int64(begin)); err != nil {
+		fmt.Printf("Error reading piece %d: %v\n", index, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// BlockFile locates a block in its data file so it can be sent without
+// going through our buffers
+func (w *FileWorker) BlockFile(index int, begin int, length int) (*os.File, int64, bool) {
+	if !w.servable(index) {
+		return nil, 0, false
+	}
+	piece := w.pieces[index]
+	if begin > piece.Length || length > piece.Length-begin {
+		return nil, 0, false
+	}
+	return w.files[piece.File], piece.Offset + int64(begin), true
+}
+
+// servable reports whether a piece may be served. The first time a piece is
+// asked for it is read whole and checked, a piece whose data no longer
+// matches its hash is withdrawn instead of being served.
+func (w *FileWorker) servable(index int) bool {
+	verified, _ := storage.Verified(w.infoHash)
+	if index < 0 || index >= len(w.pieces) || w.files[w.pieces[index].File] == nil || !verified.Has(index) {
+		return false
+	}
+	if w.checked.Has(index) {
+		return true
+	}
+	piece := w.pieces[index]
+	data := make([]byte, piece.Length)
+	if _, err := w.files[piece.File].ReadAt(data, piece.Offset); err != nil {
+		fmt.Printf("Error reading piece %d: %v\n", index, err)
+		return false
+	}
+	return w.check(index, data)
+}
 
-	// Calculate piece hashes
-	pieceHashes := make([][20]byte, len(pieces))
-	for i, piece := range pieces {
-		pieceHashes[i] = sha1.Sum(piece)
+func (w *FileWorker) check(index int, data []byte) bool {
+	if hash := sha1.Sum(data); !bytes.Equal(hash[:], w.pieces[index].Hash[:]) {
+		fmt.Printf("Piece %d of %s failed verification, no longer serving it\n", index, w.infoHash)
+		storage.MarkCorrupt(w.infoHash, index)
+		return false
 	}
+	w.checked.Set(index)
+	return true
+}
+
+// pieceSource is what a session serves from: a complete file on disk or the
+// verified pieces of a download still in progress
+type pieceSource interface {
+	NumPieces() int
+	Bitfield() storage.Bitfield
+	Block(index int, begin int, length int) ([]byte, bool)
+}
 
-	return &FileWorker{
-		filePath:    filePath,
-		pieces:      pieces,
-		numPieces:   len(pieces),
-		pieceHashes: pieceHashes,
-	}, nil
+// blockFileSource is a pieceSource whose blocks can be sent straight from
+// the data file
+type blockFileSource interface {
+	BlockFile(index int, begin int, length int) (*os.File, int64, bool)
 }
 
-// Global map to store workers associated with info hashes
-var connectionWorkers = make(map[string]*FileWorker)
+// choker hands out the upload slots shared by every connection
+var choker = NewChoker(uploadSlots)
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	s := newSession(conn)
+	sessionsMu.Lock()
+	if draining {
+		sessionsMu.Unlock()
+		return
+	}
+	sessions[s] = struct{}{}
+	sessionsWG.Add(1)
+	sessionsMu.Unlock()
+	defer func() {
+		sessionsMu.Lock()
+		delete(sessions, s)
+		sessionsMu.Unlock()
+		sessionsWG.Done()
+	}()
+	defer s.close()
+
 	// Create a buffered reader to process incoming data
 	reader := bufio.NewReader(conn)
 
+	var partial string // a line interrupted by a read deadline
 	for {
+		// A peer must bind the session quickly, then keep it busy
+		timeout := idleTimeout
+		if s.pieces == nil {
+			timeout = handshakeTimeout
+		}
+		if !s.setReadDeadline(timeout) {
+			return
+		}
 		// Read client request
-		message, err := reader.ReadString('\n')
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Printf("Error reading from connection: %v\n", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !isDraining() {
+				partial += line
+				if s.pieces != nil && s.idle() < idleTimeout {
+					// Still sending blocks to the peer
+					continue
+				}
+				reason := "Idle timeout"
+				if s.pieces == nil {
+					reason = "Handshake timeout"
+				}
+				fmt.Printf("Closing session with %s: %s\n", s.peer, reason)
+				s.send(fmt.Sprintf("ERROR: %s\n", reason))
+				return
+			}
+			if !isDraining() {
+				fmt.Printf("Error reading from connection: %v\n", err)
+			}
 			return
 		}
-		message = strings.TrimSpace(message)
-		fmt.Printf("Received message: %s\n", message)
+		s.touchRead()
+		message := strings.TrimSpace(partial + line)
+		partial = ""
 
 		// Process the message based on its type
 		switch {
 		case strings.HasPrefix(message, "test:"):
 			fmt.Printf("Received test message: %s\n", message)
-			conn.Write([]byte("OK\n"))
-		case strings.HasPrefix(message, "HANDSHAKE:"):
+			s.send("OK\n")
+		case strings.HasPrefix(message, "SECURE:"):
+			// The key exchange of a restricted swarm comes before anything
+			// else, the rest of the session is encrypted
+			if s.pieces != nil || s.swarmKey != "" {
+				s.send("ERROR: Key exchange must come first\n")
+				continue
+			}
+			secure, swarmKey, err := swarm.Server(conn, reader, message)
+			if err != nil {
+				fmt.Printf("Key exchange with %s failed: %v\n", s.peer, err)
+				s.send("ERROR: Unknown swarm key\n")
+				return
+			}
+			sessionsMu.Lock()
+			s.conn = secure
+			sessionsMu.Unlock()
+			s.swarmKey = swarmKey
+			reader = bufio.NewReader(secure)
 
-			infoHash, worker := handleHandshake(conn, message)
-			if worker == nil {
+		case strings.HasPrefix(message, "HANDSHAKE:"):
+			fmt.Printf("Received message: %s\n", message)
+			if s.pieces != nil {
+				s.send("ERROR: Session already bound to a torrent\n")
+				continue
+			}
+			infoHash, pieces := handleHandshake(s, message)
+			if pieces == nil {
 				return
 			}
-			// Store the worker in the global map using info hash
-			connectionWorkers[infoHash] = worker
-
-		case strings.HasPrefix(message, "Requesting"):
-			parts := strings.Split(message, ":")
-			infoHash := parts[1]
-			worker, exists := connectionWorkers[infoHash]
-			if !exists || worker == nil {
-				conn.Write([]byte("ERROR: Handshake required\n"))
+			sessionsMu.Lock()
+			s.infoHash = infoHash
+			sessionsMu.Unlock()
+			s.pieces = pieces
+			// Tell the peer which pieces we hold, then keep it informed
+			bitfield := pieces.Bitfield()
+			s.send(fmt.Sprintf("BITFIELD:%s\n", bitfield))
+			go s.announcePieces(bitfield)
+			go s.serveRequests()
+			go s.keepAlive()
+
+		case message == "KEEPALIVE":
+			// Only resets the idle timeout
+
+		case strings.HasPrefix(message, "EXTENDED:"):
+			reply, err := s.negotiate(message)
+			if err != nil {
+				s.send(fmt.Sprintf("ERROR: %v\n", err))
+				continue
+			}
+			s.send(reply)
+
+		case strings.HasPrefix(message, "REQUEST:"), strings.HasPrefix(message, "CANCEL:"):
+			if s.pieces == nil {
+				s.send("ERROR: Handshake required\n")
+				continue
+			}
+			req, err := parseBlockRequest(message)
+			if err != nil {
+				s.send(fmt.Sprintf("ERROR: %v\n", err))
+				continue
+			}
+			if strings.HasPrefix(message, "CANCEL:") {
+				s.cancel(req)
 				continue
 			}
-			fmt.Printf("Received piece request: %s\n", message)
-			handlePieceRequest(conn, message, worker)
+			if err := s.enqueue(req); err != nil {
+				s.send(fmt.Sprintf("REJECT:%s\n", req))
+			}
 
 		default:
 			fmt.Printf("Unknown message: %s\n", message)
-			conn.Write([]byte("ERROR: Unknown message\n"))
+			s.send("ERROR: Unknown message\n")
 		}
 	}
 }
@@ -150,67 +430,62 @@ func ParseTorrentFile(torrent_file_name string) ([]torrent.TorrentFile, error) {
 	return tfs, nil
 }
 
-func handleHandshake(conn net.Conn, message string) (string, *FileWorker) {
+func handleHandshake(s *session, message string) (string, pieceSource) {
 	// Get the info hash from the message
-	torrent_file_name := strings.TrimPrefix(message, "HANDSHAKE:")
-	//Check if the infohash is in the list of torrent files
-	torrentFiles, err := ListTorrentFiles()
-	if err != nil {
-		fmt.Printf("Error listing torrent files: %v\n", err)
-		return "", nil
+	infoHash := strings.ToLower(strings.TrimPrefix(message, "HANDSHAKE:"))
+
+	// The info hash of a torrent, or of one of its files, binds the session
+	// to the whole torrent. The torrent may have been added since the last
+	// refresh.
+	entry := index.lookup(infoHash)
+	if entry == nil {
+		index.refresh()
+		entry = index.lookup(infoHash)
 	}
-	found := false
-	for _, file := range torrentFiles {
-		if strings.TrimSuffix(file, ".torrent") == torrent_file_name {
-			found = true
-			break
-		}
+	swarmKey := ""
+	if entry != nil {
+		infoHash = entry.InfoHash
+		swarmKey = entry.Files[0].SwarmKey
 	}
-	if !found {
-		fmt.Printf("This torrent file is not in the list of torrent files currently available\n")
-		return "", nil
+	partial := storage.Lookup(infoHash)
+	if partial != nil {
+		swarmKey = partial.SwarmKey
 	}
 
-	// Create worker for the file
-	tfs, err := ParseTorrentFile(torrent_file_name + ".torrent")
-	if err != nil {
-		fmt.Printf("Error parsing torrent file: %v\n", err)
+	// A restricted torrent is only served over a session encrypted with its
+	// swarm key, to anybody else it looks unknown
+	if (entry != nil || partial != nil) && swarmKey != s.swarmKey {
+		fmt.Printf("Refused torrent %s to %s: swarm key mismatch\n", infoHash, s.peer)
+		entry, partial = nil, nil
 	}
-	for _, tf := range tfs {
-		fmt.Printf("Downloading file: %v\n", tf.Name)
+
+	// A download in progress serves the pieces it has verified so far
+	if partial != nil {
+		s.send("OK\n")
+		return infoHash, partial
 	}
-	fileName := "files/" + tfs[0].Name
-	worker, err := NewFileWorker(fileName)
-	if err != nil {
-		fmt.Printf("Error creating file worker: %v\n", err)
-		conn.Write([]byte("ERROR: Unable to process file\n"))
+
+	if entry == nil {
+		fmt.Printf("No torrent with info hash %s is currently available\n", infoHash)
+		s.send("ERROR: Unknown info hash\n")
 		return "", nil
 	}
-
-	conn.Write([]byte("OK\n"))
-	return torrent_file_name, worker
-}
-
-func handlePieceRequest(conn net.Conn, message string, worker *FileWorker) {
-	parts := strings.Split(message, ":")
-	if len(parts) != 3 {
-		conn.Write([]byte("ERROR: Invalid request format\n"))
-		return
+	// Only torrents whose local data has been verified are seeded
+	if _, ok := storage.Verified(infoHash); !ok {
+		fmt.Printf("Torrent %s has not been verified yet\n", entry.TorrentName)
+		s.send("ERROR: Torrent not verified\n")
+		return "", nil
 	}
+	fmt.Printf("Serving torrent %s (%d files)\n", entry.TorrentName, len(entry.Files))
 
-	index := strings.TrimSpace(parts[2])
-	pieceIndex, err := strconv.Atoi(index)
-	if err != nil || pieceIndex < 0 || pieceIndex >= worker.numPieces {
-		conn.Write([]byte("ERROR: Invalid piece index\n"))
-		return
+	// Create worker for the files of the torrent
+	worker, err := NewFileWorker(infoHash, entry.Files)
+	if err != nil {
+		fmt.Printf("Error creating file worker: %v\n", err)
+		s.send("ERROR: Unable to process file\n")
+		return "", nil
 	}
 
-	// First send the piece size as a fixed-length header (8 bytes)
-	pieceSize := len(worker.pieces[pieceIndex])
-	sizeHeader := make([]byte, 8)
-	binary.BigEndian.PutUint64(sizeHeader, uint64(pieceSize))
-
-	// Send size header followed by piece data
-	conn.Write(sizeHeader)
-	conn.Write(worker.pieces[pieceIndex])
+	s.send("OK\n")
+	return infoHash, worker
 }
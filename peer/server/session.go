@@ -0,0 +1,387 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/ratelimit"
+	"tcp-app/storage"
+	"tcp-app/wire"
+)
+
+// Limits on what a peer may ask of one session
+const (
+	maxBlockLength    = 128 * 1024
+	maxQueuedRequests = 256
+	blockWriteTimeout = 60 * time.Second // sending one block, throttling included
+)
+
+// blockRequest addresses length bytes at offset begin of a piece
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func (r blockRequest) String() string {
+	return fmt.Sprintf("%d:%d:%d", r.index, r.begin, r.length)
+}
+
+// parseBlockRequest parses REQUEST:{index}:{begin}:{length} and the CANCEL
+// message of the same shape.
+func parseBlockRequest(message string) (blockRequest, error) {
+	parts := strings.Split(message, ":")
+	if len(parts) != 4 {
+		return blockRequest{}, errors.New("Invalid request format")
+	}
+	var fields [3]int
+	for i, part := range parts[1:] {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return blockRequest{}, errors.New("Invalid request format")
+		}
+		fields[i] = n
+	}
+	return blockRequest{index: fields[0], begin: fields[1], length: fields[2]}, nil
+}
+
+// session is the state of one peer connection. The handshake binds it to a
+// torrent; block requests are then queued and served in order by
+// serveRequests, so a CANCEL can still drop the ones not sent yet.
+type session struct {
+	conn     net.Conn
+	peer     string // choker id, the remote address of the connection
+	infoHash string
+	pieces   pieceSource
+	swarmKey string // id of the swarm key the peer proved it holds
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	ext       wire.Extensions // what was agreed in the extension handshake
+	lastRead  time.Time
+	lastWrite time.Time // any line or block we sent, keepalives included
+	lastBlock time.Time // block data we sent
+	queue     []blockRequest
+	wake      chan struct{}
+	closed    chan struct{}
+	served    chan struct{} // closed when serveRequests returns
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:      conn,
+		peer:      conn.RemoteAddr().String(),
+		ext:       wire.Base(),
+		lastRead:  time.Now(),
+		lastWrite: time.Now(),
+		lastBlock: time.Now(),
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		served:    make(chan struct{}),
+	}
+}
+
+// close ends the session. While the server shuts down, the blocks already
+// requested are sent first.
+func (s *session) close() {
+	close(s.closed)
+	if s.pieces != nil && isDraining() {
+		<-s.served
+	}
+	choker.Remove(s.peer)
+	if closer, ok := s.pieces.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// send writes one protocol line
+func (s *session) send(message string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+	defer s.conn.SetWriteDeadline(time.Time{})
+	_, err := s.conn.Write([]byte(message))
+	if err == nil {
+		s.touchWrite()
+	}
+	return err
+}
+
+// setReadDeadline arms the deadline of the next read, unless the server is
+// shutting down: Shutdown has then already set its own.
+func (s *session) setReadDeadline(timeout time.Duration) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if draining {
+		return false
+	}
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	return true
+}
+
+func (s *session) touchRead() {
+	s.mu.Lock()
+	s.lastRead = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *session) touchWrite() {
+	s.mu.Lock()
+	s.lastWrite = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *session) touchBlock() {
+	s.mu.Lock()
+	s.lastWrite = time.Now()
+	s.lastBlock = s.lastWrite
+	s.mu.Unlock()
+}
+
+// idle returns how long the peer has sent nothing and we have sent it no
+// block. Our own keepalives do not count, they would keep a silent peer
+// forever.
+func (s *session) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.lastRead
+	if s.lastBlock.After(last) {
+		last = s.lastBlock
+	}
+	return time.Since(last)
+}
+
+// keepAlive sends KEEPALIVE to a peer that negotiated it whenever we have
+// been silent for keepaliveInterval, so it can tell us from a dead peer
+func (s *session) keepAlive() {
+	ticker := time.NewTicker(keepaliveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			silent := time.Since(s.lastWrite) >= keepaliveInterval
+			s.mu.Unlock()
+			if silent && s.supports("KEEPALIVE") {
+				s.send("KEEPALIVE\n")
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// serverExtensions is what we advertise to peers that send an extension
+// handshake
+var serverExtensions = wire.Local(wire.Messages, maxQueuedRequests, maxBlockLength)
+
+// negotiate records the features both sides support and returns what to
+// answer the peer
+func (s *session) negotiate(message string) (string, error) {
+	remote, err := wire.ParseExtensions(message)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.ext = wire.Negotiate(serverExtensions, remote)
+	s.mu.Unlock()
+	fmt.Printf("Peer %s runs %s, protocol v%d\n", s.peer, remote.Client, remote.Version)
+	return serverExtensions.Message(), nil
+}
+
+// supports reports whether the peer understands a message type
+func (s *session) supports(message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ext.Supports(message)
+}
+
+func (s *session) enqueue(req blockRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= maxQueuedRequests {
+		return errors.New("too many outstanding requests")
+	}
+	s.queue = append(s.queue, req)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cancel drops a queued request; one already being sent is not interrupted
+func (s *session) cancel(req blockRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, queued := range s.queue {
+		if queued == req {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *session) dequeue() (blockRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return blockRequest{}, false
+	}
+	req := s.queue[0]
+	s.queue = s.queue[1:]
+	return req, true
+}
+
+// serveRequests answers queued block requests until the session ends
+func (s *session) serveRequests() {
+	defer close(s.served)
+	for {
+		req, ok := s.dequeue()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		if !choker.Allow(s.peer) {
+			if s.supports("CHOKED") {
+				s.send(fmt.Sprintf("CHOKED:%s\n", req))
+			} else {
+				s.send(fmt.Sprintf("REJECT:%s\n", req))
+			}
+			continue
+		}
+		if err := handleBlockRequest(s, req); err != nil {
+			fmt.Printf("Error sending block %s: %v\n", req, err)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// announcePieces sends HAVE for every piece a partial download completes
+// after the bitfield that was sent
+func (s *session) announcePieces(sent storage.Bitfield) {
+	partial, ok := s.pieces.(*storage.Torrent)
+	if !ok {
+		return
+	}
+	have := func(index int) {
+		if s.supports("HAVE") {
+			s.send(fmt.Sprintf("HAVE:%d\n", index))
+		}
+	}
+	updates, unsubscribe := partial.Subscribe()
+	defer unsubscribe()
+
+	// Pieces completed between the bitfield and the subscription
+	current := partial.Bitfield()
+	for i := 0; i < partial.NumPieces(); i++ {
+		if current.Has(i) && !sent.Has(i) {
+			have(i)
+		}
+	}
+	for {
+		select {
+		case index := <-updates:
+			have(index)
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func handleBlockRequest(s *session, req blockRequest) error {
+	// Plain TCP connections get the block straight from the data file
+	if source, ok := s.pieces.(blockFileSource); ok {
+		if conn, ok := s.conn.(*net.TCPConn); ok {
+			return sendBlockFile(s, conn, source, req)
+		}
+	}
+
+	// Only verified pieces are served
+	if req.length == 0 || req.length > maxBlockLength {
+		return s.send(fmt.Sprintf("REJECT:%s\n", req))
+	}
+	block, ok := s.pieces.Block(req.index, req.begin, req.length)
+	if !ok {
+		return s.send(fmt.Sprintf("REJECT:%s\n", req))
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// The header carries the block size, the data follows it
+	deadline := time.Now().Add(blockWriteTimeout)
+	s.conn.SetWriteDeadline(deadline)
+	defer s.conn.SetWriteDeadline(time.Time{})
+	if _, err := s.conn.Write([]byte(fmt.Sprintf("PIECE:%s\n", req))); err != nil {
+		return err
+	}
+	writer := &ratelimit.Writer{
+		W:        s.conn,
+		Limiters: UploadLimits.Limiters(s.infoHash),
+		Deadline: deadline,
+	}
+	n, err := writer.Write(block)
+	choker.Uploaded(s.peer, n)
+	s.touchBlock()
+	return err
+}
+
+// sendBlockFile sends a block with sendfile, the data never enters our
+// buffers. The header goes first like on the copy path and the upload limits
+// are applied chunk by chunk.
+func sendBlockFile(s *session, conn *net.TCPConn, source blockFileSource, req blockRequest) error {
+	if req.length == 0 || req.length > maxBlockLength {
+		return s.send(fmt.Sprintf("REJECT:%s\n", req))
+	}
+	file, offset, ok := source.BlockFile(req.index, req.begin, req.length)
+	if !ok {
+		return s.send(fmt.Sprintf("REJECT:%s\n", req))
+	}
+	// The file belongs to this session, its offset is ours to move
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	deadline := time.Now().Add(blockWriteTimeout)
+	conn.SetWriteDeadline(deadline)
+	defer conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte(fmt.Sprintf("PIECE:%s\n", req))); err != nil {
+		return err
+	}
+	limiters := UploadLimits.Limiters(s.infoHash)
+	sent := 0
+	for sent < req.length {
+		chunk := min(req.length-sent, ratelimit.ChunkSize)
+		if err := ratelimit.Wait(chunk, deadline, limiters...); err != nil {
+			return err
+		}
+		// A file behind a LimitedReader is what makes ReadFrom use sendfile
+		n, err := conn.ReadFrom(&io.LimitedReader{R: file, N: int64(chunk)})
+		sent += int(n)
+		choker.Uploaded(s.peer, int(n))
+		if err != nil {
+			return err
+		}
+		if n < int64(chunk) {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	s.touchBlock()
+	return nil
+}
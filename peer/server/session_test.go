@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"tcp-app/storage"
+)
+
+const benchPieceLength = 256 * 1024
+
+// benchSource serves the blocks of a data file, reading only the block like
+// FileWorker does once a piece is checked
+type benchSource struct {
+	file      *os.File
+	numPieces int
+}
+
+func (b *benchSource) NumPieces() int { return b.numPieces }
+
+func (b *benchSource) Bitfield() storage.Bitfield {
+	have := storage.NewBitfield(b.numPieces)
+	for i := 0; i < b.numPieces; i++ {
+		have.Set(i)
+	}
+	return have
+}
+
+func (b *benchSource) Block(index int, begin int, length int) ([]byte, bool) {
+	data := make([]byte, length)
+	if _, err := b.file.ReadAt(data, int64(index)*benchPieceLength+int64(begin)); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (b *benchSource) BlockFile(index int, begin int, length int) (*os.File, int64, bool) {
+	return b.file, int64(index)*benchPieceLength + int64(begin), true
+}
+
+// copyOnly hides BlockFile, so blocks take the copy path
+type copyOnly struct {
+	pieceSource
+}
+
+// benchSession returns a session over loopback TCP whose peer reads and
+// discards everything
+func benchSession(b *testing.B, pieces pieceSource) *session {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		peer, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		io.Copy(io.Discard, peer)
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	s := newSession(conn)
+	s.infoHash = "bench"
+	s.pieces = pieces
+	return s
+}
+
+func benchSourceFile(b *testing.B, numPieces int) *benchSource {
+	path := filepath.Join(b.TempDir(), "data")
+	data := make([]byte, numPieces*benchPieceLength)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { file.Close() })
+	return &benchSource{file: file, numPieces: numPieces}
+}
+
+// BenchmarkServeBlock serves the same blocks with sendfile and through the
+// rate limited copy path
+func BenchmarkServeBlock(b *testing.B) {
+	const numPieces = 16
+	for _, length := range []int{16 * 1024, maxBlockLength} {
+		for _, path := range []string{"sendfile", "copy"} {
+			b.Run(path+"/"+strconv.Itoa(length/1024)+"KiB", func(b *testing.B) {
+				source := benchSourceFile(b, numPieces)
+				var pieces pieceSource = source
+				if path == "copy" {
+					pieces = copyOnly{source}
+				}
+				s := benchSession(b, pieces)
+				blocks := benchPieceLength / length
+				b.SetBytes(int64(length))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req := blockRequest{
+						index:  i / blocks % numPieces,
+						begin:  i % blocks * length,
+						length: length,
+					}
+					if err := handleBlockRequest(s, req); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
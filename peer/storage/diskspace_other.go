@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage
+
+// freeSpace is not known on this platform, the download then fails when the
+// disk fills up
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"tcp-app/torrent"
+)
+
+// Bitfield records which pieces of a torrent are held, one bit per piece,
+// highest bit of the first byte for piece 0.
+type Bitfield []byte
+
+// NewBitfield creates an empty bitfield for numPieces pieces
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// Has reports whether piece index is set
+func (bf Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(bf) {
+		return false
+	}
+	return bf[index/8]>>(7-uint(index%8))&1 != 0
+}
+
+// Set marks piece index as held
+func (bf Bitfield) Set(index int) {
+	if index < 0 || index/8 >= len(bf) {
+		return
+	}
+	bf[index/8] |= 1 << (7 - uint(index%8))
+}
+
+// Clear marks piece index as missing
+func (bf Bitfield) Clear(index int) {
+	if index < 0 || index/8 >= len(bf) {
+		return
+	}
+	bf[index/8] &^= 1 << (7 - uint(index%8))
+}
+
+// Count returns the number of pieces held
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// String encodes the bitfield as hex for the wire
+func (bf Bitfield) String() string {
+	return hex.EncodeToString(bf)
+}
+
+// ParseBitfield decodes a hex bitfield for numPieces pieces
+func ParseBitfield(s string, numPieces int) (Bitfield, error) {
+	bf, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed bitfield: %v", err)
+	}
+	if len(bf) != (numPieces+7)/8 {
+		return nil, fmt.Errorf("bitfield has %d bytes, expected %d", len(bf), (numPieces+7)/8)
+	}
+	return bf, nil
+}
+
+// Torrent is a download in progress. Verified pieces are written to a
+// partial file next to each data file, files/{name}.part, and recorded in a
+// sidecar state file, so an interrupted download resumes where it stopped.
+// The server serves the pieces already written to other peers.
+type Torrent struct {
+	InfoHash  string
+	SwarmKey  string // only peers holding this key may be served, see package swarm
+	numPieces int
+
+	mu          sync.Mutex
+	files       []*torrentFile
+	pieces      []torrent.PieceLocation
+	have        Bitfield
+	subscribers map[chan int]struct{}
+}
+
+// torrentFile is one data file of a download
+type torrentFile struct {
+	name       string
+	file       *os.File
+	finished   bool // renamed to its final name
+	unrecorded bool // found on disk without a state file entry, every piece is hashed
+}
+
+// state is the sidecar file of a download
+type state struct {
+	InfoHash string `json:"info_hash"`
+	Pieces   int    `json:"pieces"`
+	Have     string `json:"have"` // hex bitfield
+}
+
+var (
+	mu       sync.Mutex
+	torrents = make(map[string]*Torrent)
+)
+
+// Open returns the download of a torrent, resuming it from its partial files
+// and state file when they exist. Pieces the state file records are hashed
+// again, in case the partial file changed since, and so is every piece of a
+// data file found on disk.
+func Open(infoHash string, tfs []torrent.TorrentFile) (*Torrent, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t, exists := torrents[infoHash]; exists {
+		return t, nil
+	}
+	t := &Torrent{
+		InfoHash:    infoHash,
+		SwarmKey:    tfs[0].SwarmKey,
+		pieces:      torrent.Pieces(tfs),
+		subscribers: make(map[chan int]struct{}),
+	}
+	t.numPieces = len(t.pieces)
+	t.have = NewBitfield(t.numPieces)
+	for _, tf := range tfs {
+		f, err := openDataFile(tf.Name, int64(tf.Length))
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.files = append(t.files, f)
+	}
+	saved, err := t.loadState()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Ignoring state of %s: %v\n", infoHash, err)
+	}
+	for i, piece := range t.pieces {
+		if (saved.Has(i) || t.files[piece.File].unrecorded) && t.check(i) {
+			t.have.Set(i)
+		}
+	}
+	if err := t.preallocate(tfs); err != nil {
+		t.close()
+		return nil, err
+	}
+	torrents[infoHash] = t
+	return t, nil
+}
+
+// preallocate gives every partial file its final size, so pieces can be
+// written at their offsets in any order. The files are extended without
+// writing, which leaves them sparse on file systems that support it, so the
+// free space is checked against the pieces still missing first.
+func (t *Torrent) preallocate(tfs []torrent.TorrentFile) error {
+	var missing int64
+	for i, piece := range t.pieces {
+		if !t.have.Has(i) && !t.files[piece.File].finished {
+			missing += int64(piece.Length)
+		}
+	}
+	if free, ok := freeSpace("files"); ok && free < missing {
+		return fmt.Errorf("not enough disk space: %d bytes needed, %d available", missing, free)
+	}
+	for i, f := range t.files {
+		if f.finished {
+			continue
+		}
+		info, err := f.file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != int64(tfs[i].Length) {
+			if err := f.file.Truncate(int64(tfs[i].Length)); err != nil {
+				return fmt.Errorf("failed to allocate %s: %v", tfs[i].Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// openDataFile opens the partial file of a data file, or the data file
+// itself when an earlier run already finished it. A data file of another
+// size than the torrent says is not finished: it becomes the partial file,
+// keeping the pieces it holds, and is cut to size.
+func openDataFile(name string, length int64) (*torrentFile, error) {
+	path, part := "files/"+name, "files/"+name+".part"
+	unrecorded := false
+	if _, err := os.Stat(part); os.IsNotExist(err) {
+		if info, err := os.Stat(path); err == nil {
+			if info.Size() == length {
+				file, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					return nil, fmt.Errorf("failed to open data file: %v", err)
+				}
+				return &torrentFile{name: name, file: file, finished: true, unrecorded: true}, nil
+			}
+			if err := os.Rename(path, part); err != nil {
+				return nil, fmt.Errorf("failed to resume %s: %v", name, err)
+			}
+			unrecorded = true
+		}
+	}
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial file: %v", err)
+	}
+	return &torrentFile{name: name, file: file, unrecorded: unrecorded}, nil
+}
+
+func (t *Torrent) statePath() string {
+	return "files/" + t.InfoHash + ".state"
+}
+
+func (t *Torrent) loadState() (Bitfield, error) {
+	data, err := os.ReadFile(t.statePath())
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	if st.InfoHash != t.InfoHash || st.Pieces != t.numPieces {
+		return nil, fmt.Errorf("state is for another torrent")
+	}
+	return ParseBitfield(st.Have, t.numPieces)
+}
+
+// saveState writes the state file, through a temporary file so a crash
+// never leaves it half written
+func (t *Torrent) saveState() error {
+	data, err := json.Marshal(state{InfoHash: t.InfoHash, Pieces: t.numPieces, Have: t.have.String()})
+	if err != nil {
+		return err
+	}
+	tmp := t.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.statePath())
+}
+
+// check reports whether a piece in the partial file matches its hash
+func (t *Torrent) check(index int) bool {
+	piece := t.pieces[index]
+	data := make([]byte, piece.Length)
+	if _, err := t.files[piece.File].file.ReadAt(data, piece.Offset); err != nil {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], piece.Hash[:])
+}
+
+// Lookup returns the download in progress for infoHash, or nil
+func Lookup(infoHash string) *Torrent {
+	mu.Lock()
+	defer mu.Unlock()
+	return torrents[infoHash]
+}
+
+// Close stops serving a download and closes its files. What was written so
+// far stays on disk and is resumed by the next Open.
+func (t *Torrent) Close() {
+	mu.Lock()
+	if torrents[t.InfoHash] == t {
+		delete(torrents, t.InfoHash)
+	}
+	mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.close()
+}
+
+func (t *Torrent) close() {
+	for _, f := range t.files {
+		f.file.Close()
+	}
+}
+
+// NumPieces returns the number of pieces in the torrent
+func (t *Torrent) NumPieces() int {
+	return t.numPieces
+}
+
+// Put writes a verified piece to its partial file, records it in the state
+// file and announces it to the subscribers
+func (t *Torrent) Put(index int, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index < 0 || index >= t.numPieces || t.have.Has(index) {
+		return nil
+	}
+	piece := t.pieces[index]
+	if _, err := t.files[piece.File].file.WriteAt(data, piece.Offset); err != nil {
+		return fmt.Errorf("failed to write piece %d: %v", index, err)
+	}
+	t.have.Set(index)
+	if err := t.saveState(); err != nil {
+		return fmt.Errorf("failed to save download state: %v", err)
+	}
+	for ch := range t.subscribers {
+		select {
+		case ch <- index:
+		default:
+			// A subscriber that cannot keep up misses the announcement
+		}
+	}
+	return nil
+}
+
+// Block reads length bytes at offset begin of a verified piece. A written
+// piece never changes, so the file is read without holding up Put.
+func (t *Torrent) Block(index int, begin int, length int) ([]byte, bool) {
+	t.mu.Lock()
+	if !t.have.Has(index) {
+		t.mu.Unlock()
+		return nil, false
+	}
+	piece := t.pieces[index]
+	file := t.files[piece.File].file
+	t.mu.Unlock()
+	if begin < 0 || length < 0 || begin > piece.Length || length > piece.Length-begin {
+		return nil, false
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, piece.Offset+int64(begin)); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Bitfield returns a copy of the pieces held
+func (t *Torrent) Bitfield() Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(Bitfield(nil), t.have...)
+}
+
+// FileComplete reports whether every piece of data file f has been written
+func (t *Torrent) FileComplete(f int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, piece := range t.pieces {
+		if piece.File == f && !t.have.Has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// FinishFile gives a complete data file its final name. It reports false if
+// the file was already finished.
+func (t *Torrent) FinishFile(f int) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tf := t.files[f]
+	if tf.finished {
+		return false, nil
+	}
+	if err := os.Rename("files/"+tf.name+".part", "files/"+tf.name); err != nil {
+		return false, fmt.Errorf("failed to finish %s: %v", tf.name, err)
+	}
+	tf.finished = true
+	return true, nil
+}
+
+// Finish ends a complete download: the state file is removed and the pieces
+// are from now on served from the data files.
+func (t *Torrent) Finish() error {
+	t.Close()
+	SetVerified(t.InfoHash, t.Bitfield())
+	if err := os.Remove(t.statePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Discard deletes the partial files and the state file of a download, closing
+// it first if it is open. Data files already complete are kept.
+func Discard(infoHash string, tfs []torrent.TorrentFile) error {
+	if t := Lookup(infoHash); t != nil {
+		t.Close()
+	}
+	var errs []error
+	paths := []string{"files/" + infoHash + ".state"}
+	for _, tf := range tfs {
+		paths = append(paths, "files/"+tf.Name+".part")
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Subscribe returns a channel receiving the index of every new piece, and a
+// function to stop the subscription.
+func (t *Torrent) Subscribe() (<-chan int, func()) {
+	ch := make(chan int, t.numPieces)
+	t.mu.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subscribers, ch)
+		t.mu.Unlock()
+	}
+}
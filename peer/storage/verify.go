@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sync"
+
+	"tcp-app/torrent"
+)
+
+// Pieces of local data that matched the torrent's PieceHashes, by torrent
+// info hash. Only torrents found here are seeded, and only these pieces.
+var (
+	verifiedMu sync.Mutex
+	verified   = make(map[string]Bitfield)
+	checking   = make(map[string]bool)
+)
+
+// Recheck hashes the local data of a torrent against its PieceHashes and
+// records which pieces may be served. progress, if not nil, is called after
+// every piece with the number of pieces checked so far.
+func Recheck(tfs []torrent.TorrentFile, progress func(done int, total int)) (Bitfield, error) {
+	infoHash, err := torrent.InfoHash(tfs)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%x", infoHash)
+
+	verifiedMu.Lock()
+	if checking[key] {
+		verifiedMu.Unlock()
+		return nil, fmt.Errorf("torrent is already being checked")
+	}
+	checking[key] = true
+	verifiedMu.Unlock()
+	defer func() {
+		verifiedMu.Lock()
+		delete(checking, key)
+		verifiedMu.Unlock()
+	}()
+
+	pieces := torrent.Pieces(tfs)
+	bitfield := NewBitfield(len(pieces))
+	files := make([]*os.File, len(tfs))
+	for i, tf := range tfs {
+		file, err := os.Open("files/" + tf.Name)
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+		files[i] = file
+	}
+
+	for i, piece := range pieces {
+		if file := files[piece.File]; file != nil {
+			data := make([]byte, piece.Length)
+			if _, err := file.ReadAt(data, piece.Offset); err == nil {
+				hash := sha1.Sum(data)
+				if bytes.Equal(hash[:], piece.Hash[:]) {
+					bitfield.Set(i)
+				}
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(pieces))
+		}
+	}
+
+	verifiedMu.Lock()
+	verified[key] = bitfield
+	verifiedMu.Unlock()
+	return bitfield, nil
+}
+
+// SetVerified records pieces known to be good without a check, such as the
+// pieces of a download that were verified as they arrived
+func SetVerified(infoHash string, bitfield Bitfield) {
+	verifiedMu.Lock()
+	defer verifiedMu.Unlock()
+	verified[infoHash] = append(Bitfield(nil), bitfield...)
+}
+
+// Verified returns the pieces of a torrent that passed the last check
+func Verified(infoHash string) (Bitfield, bool) {
+	verifiedMu.Lock()
+	defer verifiedMu.Unlock()
+	bitfield, exists := verified[infoHash]
+	if !exists {
+		return nil, false
+	}
+	return append(Bitfield(nil), bitfield...), true
+}
+
+// MarkCorrupt withdraws a piece whose data no longer matches its hash
+func MarkCorrupt(infoHash string, index int) {
+	verifiedMu.Lock()
+	defer verifiedMu.Unlock()
+	if bitfield, exists := verified[infoHash]; exists {
+		bitfield.Clear(index)
+	}
+}
@@ -0,0 +1,319 @@
+package swarm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownKey is returned when the other side holds none of our keys
+var ErrUnknownKey = errors.New("unknown swarm key")
+
+// The key exchange is one line each way, sent before anything else:
+//
+//	SECURE:{nonce}:{ephemeral X25519 key}:{proof}
+//
+// The proof is an HMAC with the swarm key over everything exchanged so far,
+// so each side shows it holds the key without revealing which one it is. The
+// connection keys are derived from the X25519 secret and the swarm key, then
+// every message, the handshake naming the torrent included, travels in
+// AES-GCM frames.
+const nonceSize = 16
+
+// Client runs the key exchange on a freshly dialed connection and returns
+// the encrypted connection
+func Client(conn net.Conn, id string) (net.Conn, error) {
+	key, err := Key(id)
+	if err != nil {
+		return nil, err
+	}
+	mine, err := newHello()
+	if err != nil {
+		return nil, err
+	}
+	proof := mac(key, "client", mine.nonce, mine.public())
+	if _, err := fmt.Fprintf(conn, "SECURE:%x:%x:%x\n", mine.nonce, mine.public(), proof); err != nil {
+		return nil, fmt.Errorf("failed to send key exchange: %v", err)
+	}
+
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key exchange: %v", err)
+	}
+	if strings.HasPrefix(line, "ERROR:") {
+		return nil, ErrUnknownKey
+	}
+	nonce, public, proof, err := parseHello(line)
+	if err != nil {
+		return nil, err
+	}
+	transcript := [][]byte{mine.nonce, mine.public(), nonce, public}
+	if !hmac.Equal(proof, mac(key, "server", transcript...)) {
+		return nil, errors.New("peer failed to prove it holds the swarm key")
+	}
+	send, recv, err := deriveKeys(key, mine.private, public, transcript)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, conn, send, recv)
+}
+
+// Server answers the SECURE line a client opened with, using whichever of
+// our keys the client proved it holds. r is where the rest of the client's
+// bytes are read from. It returns the encrypted connection and the key id.
+func Server(conn net.Conn, r io.Reader, line string) (net.Conn, string, error) {
+	theirNonce, theirPublic, theirProof, err := parseHello(line)
+	if err != nil {
+		return nil, "", err
+	}
+	ids, err := IDs()
+	if err != nil {
+		return nil, "", err
+	}
+	var key []byte
+	var id string
+	for _, candidate := range ids {
+		k, err := Key(candidate)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(theirProof, mac(k, "client", theirNonce, theirPublic)) {
+			key, id = k, candidate
+			break
+		}
+	}
+	if key == nil {
+		return nil, "", ErrUnknownKey
+	}
+
+	mine, err := newHello()
+	if err != nil {
+		return nil, "", err
+	}
+	transcript := [][]byte{theirNonce, theirPublic, mine.nonce, mine.public()}
+	proof := mac(key, "server", transcript...)
+	if _, err := fmt.Fprintf(conn, "SECURE:%x:%x:%x\n", mine.nonce, mine.public(), proof); err != nil {
+		return nil, "", fmt.Errorf("failed to send key exchange: %v", err)
+	}
+	recv, send, err := deriveKeys(key, mine.private, theirPublic, transcript)
+	if err != nil {
+		return nil, "", err
+	}
+	secure, err := newConn(conn, r, send, recv)
+	return secure, id, err
+}
+
+// hello is one side's contribution to the key exchange
+type hello struct {
+	nonce   []byte
+	private *ecdh.PrivateKey
+}
+
+func newHello() (hello, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return hello{}, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return hello{}, err
+	}
+	return hello{nonce: nonce, private: private}, nil
+}
+
+func (h hello) public() []byte {
+	return h.private.PublicKey().Bytes()
+}
+
+func parseHello(line string) (nonce, public, proof []byte, err error) {
+	parts := strings.Split(strings.TrimSpace(line), ":")
+	if len(parts) != 4 || parts[0] != "SECURE" {
+		return nil, nil, nil, errors.New("malformed key exchange")
+	}
+	fields := make([][]byte, 3)
+	for i, part := range parts[1:] {
+		if fields[i], err = hex.DecodeString(part); err != nil {
+			return nil, nil, nil, errors.New("malformed key exchange")
+		}
+	}
+	if len(fields[0]) != nonceSize || len(fields[1]) != 32 || len(fields[2]) != sha256.Size {
+		return nil, nil, nil, errors.New("malformed key exchange")
+	}
+	return fields[0], fields[1], fields[2], nil
+}
+
+// readLine reads one line without reading past it, the encrypted frames
+// follow right behind
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("key exchange line too long")
+}
+
+func mac(key []byte, label string, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// deriveKeys returns the client-to-server and server-to-client keys
+func deriveKeys(key []byte, private *ecdh.PrivateKey, theirPublic []byte, transcript [][]byte) ([]byte, []byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(theirPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed key exchange: %v", err)
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := mac(key, "secret", append([][]byte{shared}, transcript...)...)
+	return mac(secret, "client to server"), mac(secret, "server to client"), nil
+}
+
+// maxFrame is the most plaintext one frame carries
+const maxFrame = 16 * 1024
+
+// Conn encrypts a connection. Each frame is a 4 byte length followed by the
+// sealed data; the nonce is the frame count of its direction, so frames
+// cannot be replayed, dropped or reordered.
+type Conn struct {
+	net.Conn
+	r io.Reader
+
+	writeMu  sync.Mutex
+	sealer   cipher.AEAD
+	sendSeq  uint64
+	writeBuf []byte
+
+	readMu  sync.Mutex
+	opener  cipher.AEAD
+	recvSeq uint64
+	pending []byte // decrypted, not read yet
+
+	// A frame whose read was cut short, by a deadline, is completed by the
+	// next Read
+	header     [4]byte
+	headerRead int
+	frame      []byte // nil until the header is complete
+	frameRead  int
+}
+
+func newConn(conn net.Conn, r io.Reader, sendKey []byte, recvKey []byte) (*Conn, error) {
+	sealer, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: r, sealer: sealer, opener: opener}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		frame := append(c.writeBuf[:0], 0, 0, 0, 0)
+		frame = c.sealer.Seal(frame, seqNonce(c.sealer, c.sendSeq), chunk, nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		c.writeBuf = frame
+		c.sendSeq++
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) == 0 {
+		if c.frame == nil {
+			if err := c.fill(c.header[:], &c.headerRead); err != nil {
+				return 0, err
+			}
+			size := binary.BigEndian.Uint32(c.header[:])
+			if size > maxFrame+uint32(c.opener.Overhead()) {
+				return 0, errors.New("encrypted frame too large")
+			}
+			c.frame = make([]byte, size)
+		}
+		if err := c.fill(c.frame, &c.frameRead); err != nil {
+			return 0, err
+		}
+		frame := c.frame
+		c.headerRead, c.frame, c.frameRead = 0, nil, 0
+		plain, err := c.opener.Open(frame[:0], seqNonce(c.opener, c.recvSeq), frame, nil)
+		if err != nil {
+			return 0, errors.New("encrypted frame failed authentication")
+		}
+		c.recvSeq++
+		c.pending = plain
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill reads into buf from *filled on, and counts what it read so a read
+// that failed can be resumed
+func (c *Conn) fill(buf []byte, filled *int) error {
+	for *filled < len(buf) {
+		n, err := c.r.Read(buf[*filled:])
+		*filled += n
+		if err != nil && *filled < len(buf) {
+			if err == io.EOF && c.headerRead > 0 {
+				// The connection ended inside a frame
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package swarm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test in an empty directory, the keys are stored there
+func inTempDir(t *testing.T) {
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+}
+
+// serverSide answers the key exchange on conn like the peer server does
+func serverSide(conn net.Conn) (net.Conn, error) {
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	secure, _, err := Server(conn, conn, line)
+	if errors.Is(err, ErrUnknownKey) {
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+	}
+	return secure, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	inTempDir(t)
+	if _, err := NewKey("swarm"); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// More than a frame each way
+	request := []byte("HANDSHAKE:0123456789abcdef\n")
+	reply := bytes.Repeat([]byte("piece data "), 4000)
+	errs := make(chan error, 1)
+	go func() {
+		secure, err := serverSide(serverConn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		got := make([]byte, len(request))
+		if _, err := io.ReadFull(secure, got); err != nil {
+			errs <- err
+			return
+		}
+		if !bytes.Equal(got, request) {
+			errs <- fmt.Errorf("server got %q, want %q", got, request)
+			return
+		}
+		_, err = secure.Write(reply)
+		errs <- err
+	}()
+
+	secure, err := Client(clientConn, "swarm")
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if _, err := secure.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(reply))
+	if _, err := io.ReadFull(secure, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatal("client got a different reply than was sent")
+	}
+}
+
+func TestServerRejectsWrongKey(t *testing.T) {
+	inTempDir(t)
+	if _, err := NewKey("swarm"); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		line, err := readLine(serverConn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		// The server holds a key of the same name but another value
+		if _, err := NewKey("swarm"); err != nil {
+			errs <- err
+			return
+		}
+		_, _, err = Server(serverConn, serverConn, line)
+		if err == nil {
+			errs <- errors.New("server accepted a client with the wrong key")
+			return
+		}
+		fmt.Fprintf(serverConn, "ERROR: %v\n", err)
+		errs <- nil
+	}()
+
+	if _, err := Client(clientConn, "swarm"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("client: got %v, want %v", err, ErrUnknownKey)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRejectsWrongKey(t *testing.T) {
+	inTempDir(t)
+	if _, err := NewKey("swarm"); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// A server without the key answers with a proof made with another one
+	go func() {
+		line, err := readLine(serverConn)
+		if err != nil {
+			return
+		}
+		theirNonce, theirPublic, _, err := parseHello(line)
+		if err != nil {
+			return
+		}
+		wrongKey := make([]byte, KeySize)
+		rand.Read(wrongKey)
+		mine, err := newHello()
+		if err != nil {
+			return
+		}
+		proof := mac(wrongKey, "server", theirNonce, theirPublic, mine.nonce, mine.public())
+		fmt.Fprintf(serverConn, "SECURE:%x:%x:%x\n", mine.nonce, mine.public(), proof)
+	}()
+
+	_, err := Client(clientConn, "swarm")
+	if err == nil || !strings.Contains(err.Error(), "failed to prove") {
+		t.Fatalf("client: got %v, want a failed proof", err)
+	}
+}
+
+// frameRecorder keeps every frame a Conn writes
+type frameRecorder struct {
+	net.Conn
+	frames [][]byte
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.frames = append(r.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// sealedFrames returns the frames of messages sealed with key, one each
+func sealedFrames(t *testing.T, key []byte, messages ...string) [][]byte {
+	rec := &frameRecorder{}
+	sender, err := newConn(rec, nil, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		if _, err := sender.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.frames
+}
+
+func receiver(t *testing.T, key []byte, r io.Reader) *Conn {
+	c, err := newConn(nil, r, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTamperedFrameRejected(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	frames := sealedFrames(t, key, "HAVE:3\n")
+	frames[0][len(frames[0])-1] ^= 1
+
+	c := receiver(t, key, bytes.NewReader(frames[0]))
+	if _, err := c.Read(make([]byte, 64)); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("got %v, want an authentication failure", err)
+	}
+}
+
+func TestReorderedFramesRejected(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	frames := sealedFrames(t, key, "HAVE:3\n", "HAVE:4\n")
+
+	c := receiver(t, key, bytes.NewReader(append(frames[1], frames[0]...)))
+	if _, err := c.Read(make([]byte, 64)); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("got %v, want an authentication failure", err)
+	}
+}
+
+// timeoutError is what a read cut short by a deadline returns
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// stutterReader hands out a few bytes at a time, with a timeout after each
+type stutterReader struct {
+	data    []byte
+	timeout bool
+}
+
+func (r *stutterReader) Read(p []byte) (int, error) {
+	if r.timeout = !r.timeout; !r.timeout {
+		return 0, timeoutError{}
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 3)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadResumesAfterTimeout(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	frames := sealedFrames(t, key, "HAVE:3\n", "HAVE:4\n")
+
+	c := receiver(t, key, &stutterReader{data: bytes.Join(frames, nil)})
+	var got []byte
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := c.Read(buf)
+		got = append(got, buf[:n]...)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && time.Now().Before(deadline) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("after %q: %v", got, err)
+		}
+	}
+	if string(got) != "HAVE:3\nHAVE:4\n" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,90 @@
+// Package swarm protects restricted torrents with pre-shared swarm keys. A
+// torrent names the key of its swarm; peers holding the key authenticate each
+// other and encrypt their connection with it.
+package swarm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// KeyDir holds one {id}.key file per swarm key, the key in hex
+const KeyDir = "swarm_keys"
+
+// KeySize is the length of a swarm key in bytes
+const KeySize = 32
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// NewKey generates a random key and stores it under id
+func NewKey(id string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, saveKey(id, key)
+}
+
+// AddKey stores a key received from another member of the swarm
+func AddKey(id string, hexKey string) error {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != KeySize {
+		return fmt.Errorf("a swarm key is %d bytes of hex", KeySize)
+	}
+	return saveKey(id, key)
+}
+
+func saveKey(id string, key []byte) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid swarm key id: %s", id)
+	}
+	if err := os.MkdirAll(KeyDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath(id), []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+// Key returns the key stored under id
+func Key(id string) ([]byte, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("invalid swarm key id: %s", id)
+	}
+	data, err := os.ReadFile(keyPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no swarm key %s in %s/", id, KeyDir)
+		}
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("swarm key %s is malformed", id)
+	}
+	return key, nil
+}
+
+// IDs lists the swarm keys we hold
+func IDs() ([]string, error) {
+	entries, err := os.ReadDir(KeyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".key"); ok && validID.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func keyPath(id string) string {
+	return KeyDir + "/" + id + ".key"
+}
@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
@@ -18,18 +19,23 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	SwarmKey    string // id of the pre-shared key of a restricted swarm, empty when public
 }
 
+// The swarm key id is part of the info, so a restricted torrent never has
+// the info hash of a public torrent of the same data
 type bencodeInfo struct {
 	Pieces      string `bencode:"pieces"`
 	PieceLength int    `bencode:"piece length"`
 	Length      int    `bencode:"length"`
 	Name        string `bencode:"name"`
+	SwarmKey    string `bencode:"swarm key,omitempty"`
 }
 
 type bencodeTorrent struct {
 	Announce string        `bencode:"announce"`
 	Info     []bencodeInfo `bencode:"info"`
+	SwarmKey string        `bencode:"swarm key,omitempty"` // where older torrent files kept it
 }
 
 // Open parses a torrent file
@@ -59,15 +65,16 @@ func Open(path string) ([]TorrentFile, error) {
 	return torrentFiles, nil
 }
 
-// func (i bencodeInfo) hash() ([20]byte, error) {
-// 	var buf bytes.Buffer
-// 	err := bencode.Marshal(&buf, i)
-// 	if err != nil {
-// 		return [20]byte{}, err
-// 	}
-// 	h := sha1.Sum(buf.Bytes())
-// 	return h, nil
-// }
+// hash returns the info hash, the SHA-1 of the bencoded info dictionary
+func (i bencodeInfo) hash() ([20]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, i)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	h := sha1.Sum(buf.Bytes())
+	return h, nil
+}
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	hashLen := 20 // Length of SHA-1 hash
@@ -88,11 +95,13 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 func (bto *bencodeTorrent) toTorrentFile() ([]TorrentFile, error) {
 	torrentFiles := []TorrentFile{}
 	for _, info := range bto.Info {
-		// infoHash, err := info.hash()
-		// if err != nil {
-		// 	return []TorrentFile{}, err
-		// }
-		infoHash := sha1.Sum([]byte(info.Name))
+		if info.SwarmKey == "" {
+			info.SwarmKey = bto.SwarmKey
+		}
+		infoHash, err := info.hash()
+		if err != nil {
+			return []TorrentFile{}, err
+		}
 		pieceHashes, err := info.splitPieceHashes()
 		if err != nil {
 			return []TorrentFile{}, err
@@ -104,6 +113,7 @@ func (bto *bencodeTorrent) toTorrentFile() ([]TorrentFile, error) {
 			PieceLength: info.PieceLength,
 			Length:      info.Length,
 			Name:        info.Name,
+			SwarmKey:    info.SwarmKey,
 		}
 		torrentFiles = append(torrentFiles, t)
 	}
@@ -133,6 +143,7 @@ func (t *TorrentFile) toBencodeInfo() bencodeInfo {
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		SwarmKey:    t.SwarmKey,
 	}
 }
 
@@ -170,9 +181,6 @@ func CreateTorrent(paths []string, trackerURL string) ([]TorrentFile, error) {
 		if err != nil {
 			return nil, err
 		}
-		// Hash the file stat
-		infoHash := sha1.Sum([]byte(fileInfo.Name()))
-
 		// Use the new function to split the file into pieces
 		pieces, err := splitFileIntoPieces(file, pieceLength)
 		if err != nil {
@@ -189,12 +197,15 @@ func CreateTorrent(paths []string, trackerURL string) ([]TorrentFile, error) {
 		// Create torrent file from the data above
 		torrentFile := TorrentFile{
 			Announce:    trackerURL,
-			InfoHash:    infoHash,
 			PieceHashes: piecesHashes,
 			PieceLength: pieceLength,
 			Length:      int(fileInfo.Size()),
 			Name:        fileInfo.Name(),
 		}
+		torrentFile.InfoHash, err = torrentFile.toBencodeInfo().hash()
+		if err != nil {
+			return nil, err
+		}
 
 		torrentFiles = append(torrentFiles, torrentFile)
 	}
@@ -232,12 +243,28 @@ func (t bencodeTorrent) createTorrentFile(path string) error {
 }
 
 func Create(path []string, trackerURL string) (torrentPath string, err error) {
+	return CreateWithSwarmKey(path, trackerURL, "")
+}
+
+// CreateWithSwarmKey saves a torrent restricted to the peers holding the
+// swarm key named swarmKey. An empty swarmKey creates a public torrent.
+func CreateWithSwarmKey(path []string, trackerURL string, swarmKey string) (torrentPath string, err error) {
 	torrentFiles, err := CreateTorrent(path, trackerURL)
 	if err != nil {
 		return "", err
 	}
+	for i := range torrentFiles {
+		torrentFiles[i].SwarmKey = swarmKey
+		torrentFiles[i].InfoHash, err = torrentFiles[i].toBencodeInfo().hash()
+		if err != nil {
+			return "", err
+		}
+	}
 	// Generate torrent file name from paths by the hash of the combined paths
 	combinedPath := strings.Join(path, ",")
+	if swarmKey != "" {
+		combinedPath += "@" + swarmKey
+	}
 	//fmt.Printf("combinedPath: %s\n", combinedPath)
 	hash_file_name := sha1.Sum([]byte(combinedPath))
 	torrentFileName := fmt.Sprintf("%x.torrent", hash_file_name)
@@ -288,23 +315,50 @@ func ListTorrentFiles() ([]string, error) {
 	return torrentFiles, nil
 }
 
-// MergePieces combines pieces into a single file
-func (t *TorrentFile) MergePieces(outputPath string, pieces map[int][]byte) error {
-	file, err := os.Create("files/" + outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+// InfoHash identifies a whole torrent: the info hash of its only file, or for
+// a torrent with several files the SHA-1 of its bencoded list of infos.
+func InfoHash(tfs []TorrentFile) ([20]byte, error) {
+	if len(tfs) == 1 {
+		return tfs[0].InfoHash, nil
 	}
-	defer file.Close()
+	var infos []bencodeInfo
+	for _, tf := range tfs {
+		infos = append(infos, tf.toBencodeInfo())
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, infos); err != nil {
+		return [20]byte{}, err
+	}
+	return sha1.Sum(buf.Bytes()), nil
+}
 
-	// Write pieces in order
-	for i := 0; i < len(t.PieceHashes); i++ {
-		data, exists := pieces[i]
-		if !exists {
-			return fmt.Errorf("missing piece %d", i)
-		}
-		if _, err := file.Write(data); err != nil {
-			return fmt.Errorf("failed to write piece %d: %v", i, err)
+// PieceLocation places one piece of a torrent in its data files
+type PieceLocation struct {
+	File   int   // index of the file in the torrent
+	Index  int   // index of the piece within that file
+	Offset int64 // byte offset within that file
+	Length int
+	Hash   [20]byte
+}
+
+// Pieces numbers the pieces of a torrent across its files, in order. Every
+// file starts a new piece, so a piece never spans two files.
+func Pieces(tfs []TorrentFile) []PieceLocation {
+	var pieces []PieceLocation
+	for f, tf := range tfs {
+		for i, hash := range tf.PieceHashes {
+			length := tf.PieceLength
+			if rest := tf.Length - i*tf.PieceLength; rest < length {
+				length = rest
+			}
+			pieces = append(pieces, PieceLocation{
+				File:   f,
+				Index:  i,
+				Offset: int64(i) * int64(tf.PieceLength),
+				Length: length,
+				Hash:   hash,
+			})
 		}
 	}
-	return nil
+	return pieces
 }
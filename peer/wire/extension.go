@@ -0,0 +1,102 @@
+// Package wire holds what our server and client must agree on to talk to
+// each other: the extension handshake and the features it negotiates.
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the version of the peer protocol we speak
+const ProtocolVersion = 1
+
+// ClientName is sent to peers in the extension handshake
+const ClientName = "tcp-app/1.0"
+
+// BaseMessages are understood by every peer, including those that predate
+// the extension handshake.
+var BaseMessages = []string{"BITFIELD", "HAVE", "REQUEST", "CANCEL", "PIECE", "CHOKED", "REJECT"}
+
+// Messages are all the message types we understand. The ones beyond
+// BaseMessages are only sent to peers that negotiated them.
+var Messages = append(append([]string(nil), BaseMessages...), "KEEPALIVE")
+
+// Extensions is what a peer advertises in the extension handshake, modeled on
+// BEP 10. It is sent by the client as EXTENDED:{json} right after HANDSHAKE,
+// and the server replies the same way. A peer that does not know the message
+// answers with an error and is treated as speaking Base.
+type Extensions struct {
+	Version  int      `json:"v"`
+	Client   string   `json:"client"`
+	Messages []string `json:"m"`
+	// Limits, 0 when the peer does not set one
+	MaxRequests int `json:"reqq,omitempty"`      // queued block requests per session
+	MaxBlock    int `json:"max_block,omitempty"` // bytes in one block request
+}
+
+// Base is what we assume of a peer that sends no extension handshake
+func Base() Extensions {
+	return Extensions{Messages: BaseMessages}
+}
+
+// Local describes this client with the given limits
+func Local(messages []string, maxRequests int, maxBlock int) Extensions {
+	return Extensions{
+		Version:     ProtocolVersion,
+		Client:      ClientName,
+		Messages:    messages,
+		MaxRequests: maxRequests,
+		MaxBlock:    maxBlock,
+	}
+}
+
+// Message encodes the extension handshake as a protocol line
+func (e Extensions) Message() string {
+	data, _ := json.Marshal(e)
+	return fmt.Sprintf("EXTENDED:%s\n", data)
+}
+
+// ParseExtensions decodes an EXTENDED line
+func ParseExtensions(line string) (Extensions, error) {
+	var e Extensions
+	payload := strings.TrimPrefix(strings.TrimSpace(line), "EXTENDED:")
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		return Extensions{}, fmt.Errorf("malformed extension handshake: %v", err)
+	}
+	return e, nil
+}
+
+// Supports reports whether the message type was negotiated
+func (e Extensions) Supports(message string) bool {
+	for _, m := range e.Messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the features both sides support: the lower version, the
+// messages in common and the tighter of each limit.
+func Negotiate(local Extensions, remote Extensions) Extensions {
+	agreed := Extensions{
+		Version:     min(local.Version, remote.Version),
+		Client:      remote.Client,
+		MaxRequests: tighter(local.MaxRequests, remote.MaxRequests),
+		MaxBlock:    tighter(local.MaxBlock, remote.MaxBlock),
+	}
+	for _, m := range local.Messages {
+		if remote.Supports(m) {
+			agreed.Messages = append(agreed.Messages, m)
+		}
+	}
+	return agreed
+}
+
+func tighter(a int, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
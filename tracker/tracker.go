@@ -72,7 +72,14 @@ func handleConnection(conn net.Conn) {
 	fmt.Printf("Received data from peer: %s\n", data)
 
 	args := strings.Split(data, ":")
-	peerAddr := (args[1] + ":" + args[2])
+	// START, STOP and STOPONE carry the peer address, LIST only a file name
+	peerAddr := ""
+	if len(args) >= 3 {
+		peerAddr = args[1] + ":" + args[2]
+	} else if !strings.HasPrefix(data, "LIST:") {
+		fmt.Printf("Malformed message from peer: %s\n", data)
+		return
+	}
 
 	// Handle different commands
 	switch {